@@ -12,7 +12,7 @@ import (
 )
 
 func init() {
-	// xmpp.Debug = true
+	// slog.SetLogLoggerLevel(slog.LevelDebug)
 }
 
 // Demonstrate the API, and allow the user to interact with an XMPP
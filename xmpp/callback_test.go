@@ -0,0 +1,119 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsReplyFrom(t *testing.T) {
+	cl := &Client{Jid: "user@example.com/res"}
+	tests := []struct {
+		to, from JID
+		ok       bool
+	}{
+		{"", "", true},
+		{"", "user@example.com", true},
+		{"", "user@example.com/res", true},
+		{"", "example.com", false},
+		{"", "evil@example.com", false},
+		{"user@example.com", "", true},
+		{"user@example.com", "user@example.com/other", false},
+		{"example.com", "", true},
+		{"example.com", "example.com", true},
+		{"example.com", "user@example.com", false},
+		{"peer@example.org/r", "peer@example.org/r", true},
+		{"peer@example.org/r", "peer@example.org", false},
+		{"peer@example.org/r", "", false},
+	}
+	for _, test := range tests {
+		if ok := cl.isReplyFrom(test.to, test.from); ok != test.ok {
+			t.Errorf("reply to %q from %q: %v", test.to, test.from,
+				ok)
+		}
+	}
+}
+
+func TestCallbackSpoof(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client()
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	got := make(chan Stanza, 10)
+	iq := &Iq{Header: Header{To: "peer@example.org/r", Id: "q1",
+		Type: "get", Nested: []interface{}{&Ping{}}}}
+	cl.SetIqCallback(iq, func(st Stanza) { got <- st })
+	cl.SendRaw(iq)
+	fs.next()
+
+	fs.write(`<message id="q1" from="peer@example.org/r"/>` +
+		`<iq type="get" id="q1" from="peer@example.org/r"/>` +
+		`<iq type="result" id="q1" from="evil@example.org/r"/>` +
+		`<iq type="result" id="q1"/>` +
+		`<iq type="result" id="q1" from="peer@example.org/r"/>`)
+	select {
+	case st := <-got:
+		if st == nil || st.GetHeader().From != "peer@example.org/r" {
+			t.Errorf("callback got %#v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not called")
+	}
+	if len(got) != 0 {
+		t.Error("callback called twice")
+	}
+}
+
+func TestCallbackTimeout(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client(WithCallbackTimeout(50 * time.Millisecond))
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	got := make(chan Stanza, 1)
+	cl.SetCallback("nobody", func(st Stanza) { got <- st })
+	select {
+	case st := <-got:
+		if st != nil {
+			t.Errorf("callback got %#v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback didn't expire")
+	}
+}
+
+// Once the stream has gone, callbacks are answered straight away,
+// however many there are.
+func TestCallbackAfterClose(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client()
+	drain(cl)
+	fs.next()
+	cl.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			got := make(chan Stanza, 1)
+			cl.SetCallback("late", func(st Stanza) { got <- st })
+			if st := <-got; st != nil {
+				t.Errorf("callback got %#v", st)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callbacks not answered")
+	}
+	if _, err := cl.request(&Iq{Header: Header{Id: "x",
+		Type: "get"}}); err == nil {
+		t.Error("request after Close succeeded")
+	}
+}
@@ -0,0 +1,68 @@
+package xmpp
+
+// This file contains support for data forms, XEP-0004.
+
+import (
+	"encoding/xml"
+)
+
+// A data form. Type is "form" for one to be filled in, "submit" for
+// a filled-in one, "cancel", or "result".
+type DataForm struct {
+	XMLName      xml.Name    `xml:"jabber:x:data x"`
+	Type         string      `xml:"type,attr"`
+	Title        string      `xml:"title,omitempty"`
+	Instructions []string    `xml:"instructions"`
+	Field        []FormField `xml:"field"`
+}
+
+// A field of a data form. XEP-0004, Section 3.2.
+type FormField struct {
+	Var      string       `xml:"var,attr,omitempty"`
+	Type     string       `xml:"type,attr,omitempty"`
+	Label    string       `xml:"label,attr,omitempty"`
+	Desc     string       `xml:"desc,omitempty"`
+	Required *struct{}    `xml:"required"`
+	Value    []string     `xml:"value"`
+	Option   []FormOption `xml:"option"`
+}
+
+// One of the choices for a list field.
+type FormOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// The name of the hidden field which identifies the kind of form.
+// XEP-0068.
+const FormType = "FORM_TYPE"
+
+// Find returns the field with the given var, or nil if there's none.
+func (f *DataForm) Find(name string) *FormField {
+	for i := range f.Field {
+		if f.Field[i].Var == name {
+			return &f.Field[i]
+		}
+	}
+	return nil
+}
+
+// Value returns the first value of the field with the given var, or
+// "" if there's none.
+func (f *DataForm) Value(name string) string {
+	field := f.Find(name)
+	if field == nil || len(field.Value) == 0 {
+		return ""
+	}
+	return field.Value[0]
+}
+
+// Set sets the values of the field with the given var, adding the
+// field if it isn't there.
+func (f *DataForm) Set(name string, values ...string) {
+	if field := f.Find(name); field != nil {
+		field.Value = values
+		return
+	}
+	f.Field = append(f.Field, FormField{Var: name, Value: values})
+}
@@ -1,44 +1,519 @@
 package xmpp
 
-// Manages the stack of filters that can read and modify stanzas on
-// their way from the remote to the application.
-
-// Receive new filters on filterAdd; those new filters get added to
-// the top of the stack. Receive stanzas at the bottom of the stack on
-// input. Send stanzas out the top of the stack on output.
-func filterMgr(filterAdd <-chan Filter, input <-chan Stanza, output chan<- Stanza) {
-	defer close(output)
+// Manages the stacks of filters that can read and modify stanzas on
+// their way between the remote and the application.
+
+// Each installed Filter runs in its own goroutine, reading from its
+// own input channel and writing to its own output channel. A pump
+// goroutine moves stanzas from each filter's output to the input of
+// the next filter in the chain, so the chain can be rewired while
+// stanzas are flowing: to splice in or out a filter, only the pump
+// below it needs to be redirected. Interceptors have no goroutine of
+// their own; they're called inline by the pump below them. While one
+// is running, changes to the pump are queued for it to pick up when
+// the interceptor returns, so an interceptor may add or remove
+// filters, including itself.
+
+import (
+	"sync"
+)
+
+// Describes one installed filter.
+type FilterInfo struct {
+	Name     string
+	Priority int
+}
+
+// A FilterHandle identifies an installed filter and allows it to be
+// removed again.
+type FilterHandle struct {
+	chain *filterChain
+	stage *filterStage
+}
+
+type filterStage struct {
+	FilterInfo
+	// Set for interceptors. Otherwise this stage is a Filter with
+	// its own input channel and pump.
+	intercept Interceptor
+	in        chan Stanza
+	pump      *pump
+}
+
+type filterReq struct {
+	// Exactly one of add, remove or list is set.
+	add    *filterStage
+	filt   Filter
+	remove *filterStage
+	list   chan<- []FilterInfo
+	done   chan<- bool
+}
+
+type filterChain struct {
+	reqs chan filterReq
+	done chan struct{}
+}
+
+// Start a chain which reads stanzas from input and, after they've
+// passed through any installed filters, writes them to output. When
+// input is closed, output will be closed after all filters have
+// finished.
+func newFilterChain(input <-chan Stanza, output chan<- Stanza) *filterChain {
+	fc := &filterChain{reqs: make(chan filterReq),
+		done: make(chan struct{})}
+	go fc.manager(input, output)
+	return fc
+}
+
+func (fc *filterChain) manager(input <-chan Stanza, output chan<- Stanza) {
+	defer close(fc.done)
+	source := newPump(input, output, nil)
+	go source.run()
+	// Ordered from input to output.
+	var stages []*filterStage
+	// Removed stages whose filters haven't finished yet.
+	var draining []*filterStage
+
+	// Find the pump which feeds stage i: the pump of the nearest
+	// Filter below it, or the source.
+	owner := func(i int) (*pump, int) {
+		for j := i - 1; j >= 0; j-- {
+			if stages[j].intercept == nil {
+				return stages[j].pump, j
+			}
+		}
+		return source, -1
+	}
+	// Find the interceptors the pump of stage i must call, and the
+	// channel it must then send to.
+	target := func(i int) ([]*filterStage, chan<- Stanza) {
+		var inline []*filterStage
+		for j := i + 1; j < len(stages); j++ {
+			if stages[j].intercept == nil {
+				return inline, stages[j].in
+			}
+			inline = append(inline, stages[j])
+		}
+		return inline, output
+	}
+
 	for {
+		var req filterReq
 		select {
-		case stan, ok := <-input:
-			if !ok {
-				return
+		case req = <-fc.reqs:
+		case <-source.done:
+			// The rest of the chain closes behind it.
+			for _, st := range stages {
+				if st.pump != nil {
+					<-st.pump.done
+				}
+			}
+			for _, d := range draining {
+				<-d.pump.done
+			}
+			return
+		}
+		switch {
+		case req.add != nil:
+			st := req.add
+			i := len(stages)
+			for i > 0 && stages[i-1].Priority > st.Priority {
+				i--
+			}
+			stages = append(stages, nil)
+			copy(stages[i+1:], stages[i:])
+			stages[i] = st
+			if st.intercept == nil {
+				st.in = make(chan Stanza)
+				out := make(chan Stanza)
+				inline, next := target(i)
+				st.pump = newPump(out, next, inline)
+				go req.filt(st.in, out)
+				go st.pump.run()
 			}
-			output <- stan
+			pred, j := owner(i)
+			inline, next := target(j)
+			if !pred.control(pumpCtrl{next: next, inline: inline}) {
+				// The chain is shutting down, and
+				// everything above has been closed.
+				if st.pump != nil {
+					st.pump.control(pumpCtrl{
+						next:     st.pump.next,
+						keepOpen: true})
+					close(st.in)
+				}
+				stages = append(stages[:i], stages[i+1:]...)
+				req.done <- false
+				continue
+			}
+			req.done <- true
 
-		case filt := <-filterAdd:
-			ch := make(chan Stanza)
-			go filt(input, ch)
-			input = ch
+		case req.remove != nil:
+			i := 0
+			for i < len(stages) && stages[i] != req.remove {
+				i++
+			}
+			if i == len(stages) {
+				req.done <- false
+				continue
+			}
+			st := stages[i]
+			pred, j := owner(i)
+			if st.intercept != nil {
+				stages = append(stages[:i], stages[i+1:]...)
+				inline, next := target(j)
+				req.done <- pred.control(pumpCtrl{next: next,
+					inline: inline})
+				continue
+			}
+			inline, next := target(i)
+			// Stanzas that are still inside the filter
+			// must reach next before any that bypass it.
+			ok := pred.control(pumpCtrl{next: next,
+				inline: concatStages(pred.inline, inline),
+				wait:   st.pump.done})
+			if ok {
+				live := draining[:0]
+				for _, d := range draining {
+					select {
+					case <-d.pump.done:
+						continue
+					default:
+					}
+					if d.pump.next == st.in &&
+						!d.pump.control(pumpCtrl{next: next,
+							inline:   concatStages(d.pump.inline, inline),
+							wait:     st.pump.done,
+							keepOpen: true}) {
+						continue
+					}
+					live = append(live, d)
+				}
+				draining = live
+				st.pump.control(pumpCtrl{next: next,
+					inline: inline, keepOpen: true})
+				close(st.in)
+				draining = append(draining, st)
+			}
+			stages = append(stages[:i], stages[i+1:]...)
+			req.done <- ok
+
+		case req.list != nil:
+			infos := make([]FilterInfo, len(stages))
+			for i, st := range stages {
+				infos[i] = st.FilterInfo
+			}
+			req.list <- infos
 		}
 	}
 }
 
-// AddRecvFilter adds a new filter to the top of the stack through which
-// incoming stanzas travel on their way up to the client.
-func (cl *Client) AddRecvFilter(filt Filter) {
+// Install a filter or interceptor. These are ordered by priority,
+// lowest first, and each stanza passes through them in that
+// order. Among those with equal priority, the most recently added is
+// last. Returns nil if the chain has shut down.
+func (fc *filterChain) add(st *filterStage, filt Filter) *FilterHandle {
+	done := make(chan bool)
+	select {
+	case fc.reqs <- filterReq{add: st, filt: filt, done: done}:
+	case <-fc.done:
+		return nil
+	}
+	if !<-done {
+		return nil
+	}
+	return &FilterHandle{chain: fc, stage: st}
+}
+
+func (fc *filterChain) addFilter(name string, prio int, filt Filter) *FilterHandle {
 	if filt == nil {
+		return nil
+	}
+	st := &filterStage{FilterInfo: FilterInfo{Name: name, Priority: prio}}
+	return fc.add(st, filt)
+}
+
+func (fc *filterChain) addInterceptor(name string, prio int, f Interceptor) *FilterHandle {
+	if f == nil {
+		return nil
+	}
+	st := &filterStage{FilterInfo: FilterInfo{Name: name, Priority: prio},
+		intercept: f}
+	return fc.add(st, nil)
+}
+
+func (fc *filterChain) list() []FilterInfo {
+	ch := make(chan []FilterInfo)
+	select {
+	case fc.reqs <- filterReq{list: ch}:
+		return <-ch
+	case <-fc.done:
+		return nil
+	}
+}
+
+// Remove uninstalls the filter. A Filter's input channel is closed,
+// and any stanzas it still emits before closing its output are passed
+// on up the chain; none are lost. Calling Remove more than once has
+// no effect. An interceptor may remove itself.
+func (h *FilterHandle) Remove() {
+	if h == nil {
 		return
 	}
-	cl.recvFilterAdd <- filt
+	done := make(chan bool)
+	select {
+	case h.chain.reqs <- filterReq{remove: h.stage, done: done}:
+		<-done
+	case <-h.chain.done:
+	}
+}
+
+// Info returns the name and priority the filter was installed with.
+func (h *FilterHandle) Info() FilterInfo {
+	return h.stage.FilterInfo
+}
+
+type pumpCtrl struct {
+	// Where to send stanzas from now on.
+	next chan<- Stanza
+	// Interceptors to call before sending.
+	inline []*filterStage
+	// If non-nil, don't send anything more until this is closed.
+	wait <-chan struct{}
+	// If set, don't close next on exit.
+	keepOpen bool
+}
+
+// Moves stanzas from one channel to another, which can be changed on
+// the fly, calling any interceptors on the way.
+type pump struct {
+	src  <-chan Stanza
+	ctrl chan pumpCtrl
+	done chan struct{}
+	// Set while an interceptor is running, when control messages
+	// are queued in pending instead of sent on ctrl. busyCh wakes
+	// a sender which is waiting on ctrl.
+	lock    sync.Mutex
+	busy    bool
+	pending []pumpCtrl
+	busyCh  chan struct{}
+	// The manager's record of how this pump is configured.
+	next   chan<- Stanza
+	inline []*filterStage
+}
+
+func newPump(src <-chan Stanza, next chan<- Stanza, inline []*filterStage) *pump {
+	return &pump{src: src, next: next, inline: inline,
+		ctrl: make(chan pumpCtrl), done: make(chan struct{}),
+		busyCh: make(chan struct{}, 1)}
+}
+
+// Send a control message to the pump. Returns false if the pump has
+// already exited.
+func (p *pump) control(c pumpCtrl) bool {
+	for sent := false; !sent; {
+		p.lock.Lock()
+		if p.busy {
+			// The interceptor may be waiting on us.
+			p.pending = append(p.pending, c)
+			sent = true
+		}
+		p.lock.Unlock()
+		if sent {
+			break
+		}
+		select {
+		case p.ctrl <- c:
+			sent = true
+		case <-p.busyCh:
+		case <-p.done:
+			return false
+		}
+	}
+	p.next = c.next
+	p.inline = c.inline
+	return true
+}
+
+// Call an interceptor, and return the control messages which arrived
+// while it was running.
+func (p *pump) intercept(st *filterStage, stan Stanza) (Stanza, bool, []pumpCtrl) {
+	p.lock.Lock()
+	p.busy = true
+	p.lock.Unlock()
+	select {
+	case p.busyCh <- struct{}{}:
+	default:
+	}
+	stan, ok := st.intercept(stan)
+	p.lock.Lock()
+	p.busy = false
+	pending := p.pending
+	p.pending = nil
+	p.lock.Unlock()
+	return stan, ok, pending
+}
+
+func (p *pump) run() {
+	defer close(p.done)
+	next := p.next
+	inline := p.inline
+	var waits []<-chan struct{}
+	keepOpen := false
+	// How many of the interceptors in inline the current stanza
+	// has been through.
+	applied := 0
+	apply := func(c pumpCtrl) {
+		// If a filter or interceptor above us was removed, the
+		// stanza we're holding must still go through the
+		// interceptors that were above it.
+		applied = resume(inline[:applied], c.inline)
+		next = c.next
+		inline = c.inline
+		keepOpen = c.keepOpen
+		if c.wait != nil {
+			waits = append(waits, c.wait)
+		}
+	}
+	for {
+		var stan Stanza
+		select {
+		case c := <-p.ctrl:
+			applied = 0
+			apply(c)
+			continue
+		case s, ok := <-p.src:
+			if !ok {
+				for _, w := range waits {
+					<-w
+				}
+				if !keepOpen {
+					close(next)
+				}
+				return
+			}
+			stan = s
+			applied = 0
+		}
+	Send:
+		for {
+			if len(waits) > 0 {
+				select {
+				case <-waits[0]:
+					waits = waits[1:]
+				case c := <-p.ctrl:
+					apply(c)
+				}
+				continue
+			}
+			for applied < len(inline) {
+				var ok bool
+				var pending []pumpCtrl
+				stan, ok, pending = p.intercept(inline[applied],
+					stan)
+				applied++
+				for _, c := range pending {
+					apply(c)
+				}
+				if !ok {
+					break Send
+				}
+			}
+			select {
+			case next <- stan:
+				break Send
+			case c := <-p.ctrl:
+				apply(c)
+			}
+		}
+	}
+}
+
+// Find where a stanza which has been through the interceptors in done
+// carries on in stages: after the last of them that's still there.
+// If none are, it's been through everything it needs to.
+func resume(done, stages []*filterStage) int {
+	if len(done) == 0 {
+		return 0
+	}
+	for i := len(stages) - 1; i >= 0; i-- {
+		for _, d := range done {
+			if stages[i] == d {
+				return i + 1
+			}
+		}
+	}
+	return len(stages)
+}
+
+// Append without sharing a backing array with either argument.
+func concatStages(a, b []*filterStage) []*filterStage {
+	c := make([]*filterStage, 0, len(a)+len(b))
+	return append(append(c, a...), b...)
+}
+
+// AddRecvFilter adds a new filter to the top of the stack through which
+// incoming stanzas travel on their way up to the client. The returned
+// handle may be used to remove it again.
+func (cl *Client) AddRecvFilter(filt Filter) *FilterHandle {
+	return cl.InsertRecvFilter("", 0, filt)
 }
 
 // AddSendFilter adds a new filter to the top of the stack through
 // which outgoing stanzas travel on their way down from the client to
-// the network.
-func (cl *Client) AddSendFilter(filt Filter) {
-	if filt == nil {
-		return
-	}
-	cl.sendFilterAdd <- filt
+// the network. The returned handle may be used to remove it again.
+func (cl *Client) AddSendFilter(filt Filter) *FilterHandle {
+	return cl.InsertSendFilter("", 0, filt)
+}
+
+// InsertRecvFilter installs a named filter for incoming stanzas at
+// the given priority. Stanzas pass through filters from the lowest
+// priority to the highest; AddRecvFilter uses priority 0.
+func (cl *Client) InsertRecvFilter(name string, prio int, filt Filter) *FilterHandle {
+	return cl.recvFilters.addFilter(name, prio, filt)
+}
+
+// InsertSendFilter installs a named filter for outgoing stanzas at
+// the given priority. Stanzas pass through filters from the lowest
+// priority to the highest; AddSendFilter uses priority 0.
+func (cl *Client) InsertSendFilter(name string, prio int, filt Filter) *FilterHandle {
+	return cl.sendFilters.addFilter(name, prio, filt)
+}
+
+// AddRecvInterceptor adds an interceptor to the top of the stack
+// through which incoming stanzas travel, like AddRecvFilter.
+func (cl *Client) AddRecvInterceptor(f Interceptor) *FilterHandle {
+	return cl.InsertRecvInterceptor("", 0, f)
+}
+
+// AddSendInterceptor adds an interceptor to the top of the stack
+// through which outgoing stanzas travel, like AddSendFilter.
+func (cl *Client) AddSendInterceptor(f Interceptor) *FilterHandle {
+	return cl.InsertSendInterceptor("", 0, f)
+}
+
+// InsertRecvInterceptor installs a named interceptor for incoming
+// stanzas at the given priority. Interceptors and filters share the
+// same ordering.
+func (cl *Client) InsertRecvInterceptor(name string, prio int, f Interceptor) *FilterHandle {
+	return cl.recvFilters.addInterceptor(name, prio, f)
+}
+
+// InsertSendInterceptor installs a named interceptor for outgoing
+// stanzas at the given priority. Interceptors and filters share the
+// same ordering.
+func (cl *Client) InsertSendInterceptor(name string, prio int, f Interceptor) *FilterHandle {
+	return cl.sendFilters.addInterceptor(name, prio, f)
+}
+
+// RecvFilters lists the installed receive filters and interceptors,
+// in the order stanzas pass through them.
+func (cl *Client) RecvFilters() []FilterInfo {
+	return cl.recvFilters.list()
+}
+
+// SendFilters lists the installed send filters and interceptors, in
+// the order stanzas pass through them.
+func (cl *Client) SendFilters() []FilterInfo {
+	return cl.sendFilters.list()
 }
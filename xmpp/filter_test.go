@@ -7,14 +7,17 @@ import (
 )
 
 func TestCloseIn(t *testing.T) {
-	add := make(chan Filter)
 	in := make(chan Stanza)
 	out := make(chan Stanza)
-	go filterMgr(add, in, out)
+	fc := newFilterChain(in, out)
 	close(in)
 	_, ok := <-out
 	if ok {
-		fmt.Errorf("out didn't close")
+		t.Errorf("out didn't close")
+	}
+	<-fc.done
+	if fc.addFilter("", 0, passthru) != nil {
+		t.Errorf("added filter after close")
 	}
 }
 
@@ -32,13 +35,12 @@ func TestFilters(t *testing.T) {
 }
 
 func filterN(numFilts int, t *testing.T) {
-	add := make(chan Filter)
 	in := make(chan Stanza)
 	defer close(in)
 	out := make(chan Stanza)
-	go filterMgr(add, in, out)
+	fc := newFilterChain(in, out)
 	for i := 0; i < numFilts; i++ {
-		add <- passthru
+		fc.addFilter("", 0, passthru)
 	}
 	go func() {
 		for i := 0; i < 100; i++ {
@@ -66,3 +68,221 @@ func filterN(numFilts int, t *testing.T) {
 		}
 	}
 }
+
+// Holds on to each stanza until the next one arrives, so there's
+// always something in flight when the filter is removed.
+func laggard(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	var held Stanza
+	for stan := range in {
+		if held != nil {
+			out <- held
+		}
+		held = stan
+	}
+	if held != nil {
+		out <- held
+	}
+}
+
+func TestFilterRemove(t *testing.T) {
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	fc := newFilterChain(in, out)
+	var handles []*FilterHandle
+	for i := 0; i < 4; i++ {
+		handles = append(handles, fc.addFilter("", 0, laggard))
+	}
+	const num = 200
+	go func() {
+		for i := 0; i < num; i++ {
+			msg := Message{}
+			msg.Id = fmt.Sprintf("%d", i)
+			in <- &msg
+			switch i {
+			case 50:
+				handles[1].Remove()
+				handles[2].Remove()
+			case 100:
+				handles[0].Remove()
+			case 150:
+				handles[3].Remove()
+				handles[3].Remove()
+			}
+		}
+		close(in)
+	}()
+	i := 0
+	for stan := range out {
+		assertEquals(t, fmt.Sprintf("%d", i), stan.GetHeader().Id)
+		i++
+	}
+	if i != num {
+		t.Errorf("received %d of %d", i, num)
+	}
+	if n := len(fc.list()); n != 0 {
+		t.Errorf("%d filters left", n)
+	}
+}
+
+func TestFilterOrder(t *testing.T) {
+	in := make(chan Stanza)
+	defer close(in)
+	out := make(chan Stanza)
+	fc := newFilterChain(in, out)
+	tag := func(name string) Filter {
+		return func(in <-chan Stanza, out chan<- Stanza) {
+			defer close(out)
+			for stan := range in {
+				stan.GetHeader().Id += name
+				out <- stan
+			}
+		}
+	}
+	fc.addFilter("b", 5, tag("b"))
+	fc.addFilter("d", 10, tag("d"))
+	fc.addFilter("a", -1, tag("a"))
+	c := fc.addFilter("c", 5, tag("c"))
+	infos := fc.list()
+	names := ""
+	for _, info := range infos {
+		names += info.Name
+	}
+	assertEquals(t, "abcd", names)
+
+	in <- &Message{}
+	assertEquals(t, "abcd", (<-out).GetHeader().Id)
+	c.Remove()
+	in <- &Message{}
+	assertEquals(t, "abd", (<-out).GetHeader().Id)
+}
+
+func TestInterceptors(t *testing.T) {
+	in := make(chan Stanza)
+	defer close(in)
+	out := make(chan Stanza)
+	fc := newFilterChain(in, out)
+	tag := func(name string) Interceptor {
+		return func(stan Stanza) (Stanza, bool) {
+			stan.GetHeader().Id += name
+			return stan, true
+		}
+	}
+	tagFilter := func(name string) Filter {
+		return func(in <-chan Stanza, out chan<- Stanza) {
+			defer close(out)
+			for stan := range in {
+				stan.GetHeader().Id += name
+				out <- stan
+			}
+		}
+	}
+	drop := func(stan Stanza) (Stanza, bool) {
+		return stan, stan.GetHeader().Type != "drop"
+	}
+	fc.addInterceptor("a", 0, tag("a"))
+	b := fc.addFilter("b", 1, tagFilter("b"))
+	fc.addInterceptor("c", 2, tag("c"))
+	fc.addInterceptor("d", 2, tag("d"))
+	fc.addFilter("e", 3, tagFilter("e"))
+	fc.addInterceptor("drop", -1, drop)
+
+	in <- &Message{}
+	assertEquals(t, "abcde", (<-out).GetHeader().Id)
+	b.Remove()
+	in <- &Message{}
+	assertEquals(t, "acde", (<-out).GetHeader().Id)
+	in <- &Message{Header: Header{Type: "drop"}}
+	in <- &Message{}
+	assertEquals(t, "acde", (<-out).GetHeader().Id)
+}
+
+func TestInterceptorRemovesItself(t *testing.T) {
+	in := make(chan Stanza)
+	defer close(in)
+	out := make(chan Stanza)
+	fc := newFilterChain(in, out)
+	tag := func(name string) Interceptor {
+		return func(stan Stanza) (Stanza, bool) {
+			stan.GetHeader().Id += name
+			return stan, true
+		}
+	}
+	fc.addInterceptor("a", 0, tag("a"))
+	var once *FilterHandle
+	once = fc.addInterceptor("b", 1, func(stan Stanza) (Stanza, bool) {
+		once.Remove()
+		stan.GetHeader().Id += "b"
+		return stan, true
+	})
+	fc.addInterceptor("c", 2, tag("c"))
+
+	in <- &Message{}
+	assertEquals(t, "abc", (<-out).GetHeader().Id)
+	in <- &Message{}
+	assertEquals(t, "ac", (<-out).GetHeader().Id)
+	if n := len(fc.list()); n != 2 {
+		t.Errorf("%d filters left", n)
+	}
+}
+
+func TestInterceptorAddsFilter(t *testing.T) {
+	in := make(chan Stanza)
+	defer close(in)
+	out := make(chan Stanza)
+	fc := newFilterChain(in, out)
+	tagFilter := func(in <-chan Stanza, out chan<- Stanza) {
+		defer close(out)
+		for stan := range in {
+			stan.GetHeader().Id += "f"
+			out <- stan
+		}
+	}
+	added := false
+	fc.addInterceptor("a", 0, func(stan Stanza) (Stanza, bool) {
+		if !added {
+			added = fc.addFilter("f", 1, tagFilter) != nil
+		}
+		stan.GetHeader().Id += "a"
+		return stan, true
+	})
+
+	in <- &Message{}
+	assertEquals(t, "af", (<-out).GetHeader().Id)
+	in <- &Message{}
+	assertEquals(t, "af", (<-out).GetHeader().Id)
+}
+
+func benchmarkChain(b *testing.B, add func(fc *filterChain)) {
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	fc := newFilterChain(in, out)
+	add(fc)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			in <- &Message{}
+		}
+		close(in)
+	}()
+	b.ResetTimer()
+	for range out {
+	}
+}
+
+func BenchmarkFilters(b *testing.B) {
+	benchmarkChain(b, func(fc *filterChain) {
+		for i := 0; i < 5; i++ {
+			fc.addFilter("", 0, passthru)
+		}
+	})
+}
+
+func BenchmarkInterceptors(b *testing.B) {
+	benchmarkChain(b, func(fc *filterChain) {
+		for i := 0; i < 5; i++ {
+			fc.addInterceptor("", 0, func(stan Stanza) (Stanza, bool) {
+				return stan, true
+			})
+		}
+	})
+}
@@ -3,27 +3,49 @@ package xmpp
 // Code to generate unique IDs for outgoing messages.
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 )
 
-var id <-chan string
-
-func init() {
-	// Start the unique id generator.
-	idCh := make(chan string)
-	id = idCh
-	go func(ch chan<- string) {
-		id := int64(1)
-		for {
-			str := fmt.Sprintf("id_%d", id)
-			ch <- str
-			id++
-		}
-	}(idCh)
+// An IdGenerator makes ids for outgoing stanzas. It must be safe for
+// concurrent use.
+type IdGenerator interface {
+	NextId() string
+}
+
+// RandomIds is the default IdGenerator. Its ids are 128 random bits,
+// hex-encoded, so they can't be predicted by others and won't repeat
+// across sessions.
+type RandomIds struct{}
+
+func (RandomIds) NextId() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// WithIdGenerator sets the generator of the ids the client gives its
+// own stanzas.
+func WithIdGenerator(g IdGenerator) Option {
+	return func(cl *Client) {
+		cl.ids = g
+	}
+}
+
+// NextId returns a new id from the client's generator, for an
+// outgoing iq, message, or presence stanza.
+func (cl *Client) NextId() string {
+	if cl.ids == nil {
+		return RandomIds{}.NextId()
+	}
+	return cl.ids.NextId()
 }
 
 // This function may be used as a convenient way to generate a unique
-// id for an outgoing iq, message, or presence stanza.
+// id for an outgoing iq, message, or presence stanza. It uses
+// RandomIds; Client.NextId uses the client's own generator.
 func NextId() string {
-	return <-id
+	return RandomIds{}.NextId()
 }
@@ -0,0 +1,58 @@
+package xmpp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRandomIds(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := RandomIds{}.NextId()
+		if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+			t.Fatalf("bad id %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("repeated id %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+type seqIds struct {
+	n atomic.Int32
+}
+
+func (s *seqIds) NextId() string {
+	return fmt.Sprintf("seq%d", s.n.Add(1))
+}
+
+func TestIdGenerator(t *testing.T) {
+	var lock sync.Mutex
+	var ids []string
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.handle = func(fs *fakeServer, e *rawElem) bool {
+		if e.XMLName.Local == "iq" {
+			lock.Lock()
+			ids = append(ids, e.attr("id"))
+			lock.Unlock()
+		}
+		return false
+	}
+	cl := fs.client(WithIdGenerator(&seqIds{}))
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{"seq1", "seq2", "seq3"}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("ids %v", ids)
+	}
+	assertEquals(t, "seq4", cl.NextId())
+}
@@ -0,0 +1,133 @@
+package xmpp
+
+// This file contains support for choosing among multiple localized
+// versions of human-readable text. See RFC 6120, Section 8.1.5, and
+// RFC 4647, Section 3.4.
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// WithLanguages sets the client's preferred languages, most preferred
+// first. The first one is announced as the default language of our
+// stream.
+func WithLanguages(langs ...string) Option {
+	return func(cl *Client) {
+		cl.Languages = langs
+	}
+}
+
+// BodyFor returns the body of the message in the best available
+// language. Each of langs is tried in order using RFC 4647 lookup; if
+// none matches, the message's own default language is used.
+func (m *Message) BodyFor(langs ...string) string {
+	return lookupText(m.Body, m.Lang, langs)
+}
+
+// SubjectFor returns the subject of the message in the best available
+// language, as described for BodyFor.
+func (m *Message) SubjectFor(langs ...string) string {
+	return lookupText(m.Subject, m.Lang, langs)
+}
+
+// StatusFor returns the status text of the presence in the best
+// available language, as described for Message.BodyFor.
+func (p *Presence) StatusFor(langs ...string) string {
+	return lookupText(p.Status, p.Lang, langs)
+}
+
+// AddBody adds a body in the given language. It may be called once
+// per language to build a message with several localized bodies. An
+// empty lang means the stanza's default language.
+func (m *Message) AddBody(lang, text string) {
+	m.Body = append(m.Body, newText("body", lang, text))
+}
+
+// AddSubject adds a subject in the given language, as for AddBody.
+func (m *Message) AddSubject(lang, text string) {
+	m.Subject = append(m.Subject, newText("subject", lang, text))
+}
+
+// AddStatus adds status text in the given language, as for
+// Message.AddBody.
+func (p *Presence) AddStatus(lang, text string) {
+	p.Status = append(p.Status, newText("status", lang, text))
+}
+
+// Body returns the message's body in the client's preferred
+// language.
+func (cl *Client) Body(m *Message) string {
+	return m.BodyFor(cl.Languages...)
+}
+
+// Subject returns the message's subject in the client's preferred
+// language.
+func (cl *Client) Subject(m *Message) string {
+	return m.SubjectFor(cl.Languages...)
+}
+
+// StatusText returns the presence's status text in the client's
+// preferred language.
+func (cl *Client) StatusText(p *Presence) string {
+	return p.StatusFor(cl.Languages...)
+}
+
+func newText(local, lang, text string) Text {
+	return Text{XMLName: xml.Name{Space: NsClient, Local: local},
+		Lang: lang, Chardata: text}
+}
+
+// Choose among texts. A text with no xml:lang inherits deflt, the
+// language of the enclosing stanza. If nothing matches any of the
+// requested languages or the default, the first text is returned.
+func lookupText(texts []Text, deflt string, langs []string) string {
+	if len(texts) == 0 {
+		return ""
+	}
+	tags := make([]string, len(texts))
+	for i, t := range texts {
+		tags[i] = t.Lang
+		if tags[i] == "" {
+			tags[i] = deflt
+		}
+	}
+	for _, lang := range langs {
+		if i := langLookup(tags, lang); i >= 0 {
+			return texts[i].Chardata
+		}
+	}
+	if deflt != "" {
+		if i := langLookup(tags, deflt); i >= 0 {
+			return texts[i].Chardata
+		}
+	}
+	return texts[0].Chardata
+}
+
+// Find the index of the tag best matching the language range, using
+// the lookup scheme of RFC 4647, Section 3.4: the range is
+// progressively truncated until it matches one of the tags. Returns -1
+// if there's no match.
+func langLookup(tags []string, rng string) int {
+	rng = strings.ToLower(rng)
+	if rng == "" || rng == "*" {
+		return -1
+	}
+	for {
+		for i, tag := range tags {
+			if strings.ToLower(tag) == rng {
+				return i
+			}
+		}
+		dash := strings.LastIndex(rng, "-")
+		if dash == -1 {
+			return -1
+		}
+		rng = rng[:dash]
+		// Don't leave a singleton subtag dangling at the end.
+		if len(rng) >= 2 && rng[len(rng)-2] == '-' {
+			rng = rng[:len(rng)-2]
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestLangLookup(t *testing.T) {
+	tags := []string{"en", "de-CH", "zh-Hant"}
+	if i := langLookup(tags, "de-CH-1996"); i != 1 {
+		t.Errorf("de-CH-1996: got %d", i)
+	}
+	if i := langLookup(tags, "EN-us"); i != 0 {
+		t.Errorf("EN-us: got %d", i)
+	}
+	if i := langLookup(tags, "zh-Hant-x-private"); i != 2 {
+		t.Errorf("zh-Hant-x-private: got %d", i)
+	}
+	if i := langLookup(tags, "de"); i != -1 {
+		t.Errorf("de: got %d", i)
+	}
+	if i := langLookup(tags, "*"); i != -1 {
+		t.Errorf("*: got %d", i)
+	}
+}
+
+func TestBodyFor(t *testing.T) {
+	msg := &Message{}
+	msg.Lang = "en"
+	msg.AddBody("", "hello")
+	msg.AddBody("fr", "bonjour")
+	msg.AddBody("de", "hallo")
+	assertEquals(t, "bonjour", msg.BodyFor("fr-CA"))
+	assertEquals(t, "hallo", msg.BodyFor("es", "de"))
+	assertEquals(t, "hello", msg.BodyFor("en-GB"))
+	assertEquals(t, "hello", msg.BodyFor("es"))
+	assertEquals(t, "hello", msg.BodyFor())
+
+	msg = &Message{}
+	msg.AddBody("fr", "bonjour")
+	msg.AddBody("de", "hallo")
+	assertEquals(t, "bonjour", msg.BodyFor("es"))
+	assertEquals(t, "", (&Message{}).BodyFor("en"))
+
+	cl := &Client{Languages: []string{"de-AT", "fr"}}
+	assertEquals(t, "hallo", cl.Body(msg))
+}
+
+func TestAddBodyMarshal(t *testing.T) {
+	msg := &Message{}
+	msg.AddBody("en", "hi")
+	msg.AddSubject("", "topic")
+	exp := `<message xmlns="jabber:client"><subject xmlns="` + NsClient +
+		`">topic</subject><body xmlns="` + NsClient +
+		`" xml:lang="en">hi</body></message>`
+	assertMarshal(t, exp, msg)
+}
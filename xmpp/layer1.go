@@ -5,130 +5,166 @@ package xmpp
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sync"
 	"time"
 )
 
-// If enabled, print all sent and received XML.
-var Debug = false
-
-var l1interval = time.Second
-
+// The transport has no timers and does no polling. Reads block until
+// data arrives; the socket is swapped for a TLS one by interrupting
+// the blocked read, and the connection is shut down by closing the
+// socket.
 type layer1 struct {
-	sock      net.Conn
-	recvSocks chan<- net.Conn
-	sendSocks chan net.Conn
+	// Protects the fields below.
+	lock sync.Mutex
+	// Signalled when the receiver takes up a pending socket.
+	switched *sync.Cond
+	sock     net.Conn
+	// A TLS socket waiting for the receiver to switch to it.
+	pending net.Conn
+	closed  bool
+	// The sender's input, closed on shutdown.
+	sendReader io.ReadCloser
 }
 
 func (cl *Client) startLayer1(sock net.Conn, recvWriter io.WriteCloser,
 	sendReader io.ReadCloser, status <-chan Status) *layer1 {
-	l1 := layer1{sock: sock}
-	recvSocks := make(chan net.Conn)
-	l1.recvSocks = recvSocks
-	sendSocks := make(chan net.Conn, 1)
-	l1.sendSocks = sendSocks
-	go cl.recvTransport(recvSocks, recvWriter, status)
-	go cl.sendTransport(sendSocks, sendReader)
-	recvSocks <- sock
-	sendSocks <- sock
-	return &l1
-}
-
-func (l1 *layer1) startTls(conf *tls.Config) {
-	sendSockToSender := func(sock net.Conn) {
-		for {
-			select {
-			case <-l1.sendSocks:
-			case l1.sendSocks <- sock:
+	l1 := &layer1{sock: sock, sendReader: sendReader}
+	l1.switched = sync.NewCond(&l1.lock)
+	cl.spawn(func() { cl.recvTransport(l1, sock, recvWriter) })
+	cl.spawn(func() { cl.sendTransport(l1, sendReader) })
+	cl.spawn(func() {
+		for stat := range status {
+			if stat.Fatal() {
+				l1.close()
 				return
 			}
 		}
+	})
+	return l1
+}
+
+// Switch to TLS. This must only be called when the server is waiting
+// for us to begin the TLS handshake, so nothing more will arrive on
+// the unencrypted socket.
+func (l1 *layer1) startTls(conf *tls.Config) {
+	l1.lock.Lock()
+	defer l1.lock.Unlock()
+	if l1.closed {
+		return
+	}
+	// Wake the receiver from its read on the old socket. Until it
+	// has switched, the sender waits.
+	l1.pending = tls.Client(l1.sock, conf)
+	l1.sock.SetReadDeadline(time.Now())
+}
+
+// Called by the receiver when its read times out. Returns the socket
+// to read from next, or nil if there's no switch to make.
+func (l1 *layer1) takePending() net.Conn {
+	l1.lock.Lock()
+	defer l1.lock.Unlock()
+	if l1.pending == nil || l1.closed {
+		return nil
+	}
+	l1.sock, l1.pending = l1.pending, nil
+	l1.sock.SetReadDeadline(time.Time{})
+	l1.switched.Broadcast()
+	return l1.sock
+}
+
+// The socket for the sender to write to.
+func (l1 *layer1) currentSock() net.Conn {
+	l1.lock.Lock()
+	defer l1.lock.Unlock()
+	for l1.pending != nil && !l1.closed {
+		l1.switched.Wait()
 	}
+	return l1.sock
+}
 
-	sendSockToSender(nil)
-	l1.recvSocks <- nil
-	l1.sock = tls.Client(l1.sock, conf)
-	sendSockToSender(l1.sock)
-	l1.recvSocks <- l1.sock
+func (l1 *layer1) isClosed() bool {
+	l1.lock.Lock()
+	defer l1.lock.Unlock()
+	return l1.closed
 }
 
-func (cl *Client) recvTransport(socks <-chan net.Conn, w io.WriteCloser,
-	status <-chan Status) {
+// Tell the server we won't send anything more, while still allowing
+// it to finish sending to us.
+func (l1 *layer1) closeWrite() {
+	l1.lock.Lock()
+	defer l1.lock.Unlock()
+	cw, ok := l1.sock.(interface{ CloseWrite() error })
+	if ok && !l1.closed {
+		cw.CloseWrite()
+	}
+}
 
+// Close the connection, which unblocks the receiver and the sender.
+func (l1 *layer1) close() {
+	l1.lock.Lock()
+	defer l1.lock.Unlock()
+	if !l1.closed {
+		l1.closed = true
+		l1.switched.Broadcast()
+		l1.sock.Close()
+		l1.sendReader.Close()
+	}
+}
+
+func (cl *Client) recvTransport(l1 *layer1, sock net.Conn, w io.WriteCloser) {
 	defer w.Close()
-	var sock net.Conn
 	p := make([]byte, 1024)
 	for {
-		select {
-		case stat := <-status:
-			if stat.Fatal() {
-				return
-			}
-
-		case sock = <-socks:
-		default:
-		}
-
-		if sock == nil {
-			time.Sleep(l1interval)
-		} else {
-			sock.SetReadDeadline(time.Now().Add(l1interval))
-			nr, err := sock.Read(p)
-			if nr == 0 {
-				if errno, ok := err.(*net.OpError); ok {
-					if errno.Timeout() {
-						continue
-					}
+		nr, err := sock.Read(p)
+		if nr == 0 {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				if next := l1.takePending(); next != nil {
+					sock = next
+					continue
 				}
-				cl.setError(fmt.Errorf("recv: %v", err))
-				return
 			}
-			if Debug {
-				log.Printf("recv: %s", p[:nr])
+			if !l1.isClosed() {
+				cl.setError(fmt.Errorf("recv: %v", err))
 			}
-			nw, err := w.Write(p[:nr])
-			if nw < nr {
+			return
+		}
+		nw, err := w.Write(p[:nr])
+		if nw < nr {
+			// The reader stops at the end of the
+			// server's stream.
+			if err != io.ErrClosedPipe {
 				cl.setError(fmt.Errorf("recv: %v", err))
-				return
 			}
+			return
 		}
 	}
 }
 
-func (cl *Client) sendTransport(socks <-chan net.Conn, r io.Reader) {
-	var sock net.Conn
+func (cl *Client) sendTransport(l1 *layer1, r io.Reader) {
 	p := make([]byte, 1024)
 	for {
 		nr, err := r.Read(p)
 		if nr == 0 {
-			cl.setError(fmt.Errorf("send: %v", err))
-			break
-		}
-		if nr > 0 && Debug {
-			log.Printf("send: %s", p[:nr])
-		}
-		for nr > 0 {
-			select {
-			case sock = <-socks:
-				if sock != nil {
-					defer sock.Close()
-				}
-			default:
+			if err == io.EOF {
+				// The layer above has ended our
+				// stream.
+				l1.closeWrite()
+			} else if !l1.isClosed() {
+				cl.setError(fmt.Errorf("send: %v", err))
 			}
-
-			if sock == nil {
-				time.Sleep(l1interval)
-			} else {
-				nw, err := sock.Write(p[:nr])
-				nr -= nw
-				if nr != 0 {
-					cl.setError(fmt.Errorf("send: %v", err))
-					break
-				}
+			return
+		}
+		_, err = l1.currentSock().Write(p[:nr])
+		if err != nil {
+			if !l1.isClosed() {
+				cl.setError(fmt.Errorf("send: %v", err))
 			}
+			return
 		}
 	}
 }
@@ -0,0 +1,100 @@
+package xmpp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLayer1Close(t *testing.T) {
+	local, remote := net.Pipe()
+	recvReader, recvWriter := io.Pipe()
+	sendReader, sendWriter := io.Pipe()
+	status := make(chan Status, 1)
+	cl := &Client{}
+	cl.startLayer1(local, recvWriter, sendReader, status)
+
+	go sendWriter.Write([]byte("ping"))
+	p := make([]byte, 4)
+	if _, err := io.ReadFull(remote, p); err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "ping", string(p))
+
+	go remote.Write([]byte("pong"))
+	if _, err := io.ReadFull(recvReader, p); err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "pong", string(p))
+
+	status <- StatusShutdown
+	if _, err := recvReader.Read(p); err != io.EOF {
+		t.Errorf("recv after shutdown: %v", err)
+	}
+	if _, err := sendWriter.Write(p); err == nil {
+		t.Error("send after shutdown succeeded")
+	}
+}
+
+func TestLayer1StartTls(t *testing.T) {
+	local, remote := net.Pipe()
+	recvReader, recvWriter := io.Pipe()
+	sendReader, sendWriter := io.Pipe()
+	cl := &Client{}
+	l1 := cl.startLayer1(local, recvWriter, sendReader, nil)
+
+	// The receiver is now blocked reading the plain socket.
+	go remote.Write([]byte("<proceed/>"))
+	p := make([]byte, 10)
+	if _, err := io.ReadFull(recvReader, p); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := tls.Server(remote, &tls.Config{
+		Certificates: []tls.Certificate{testCert(t)}})
+	go func() {
+		q := make([]byte, 5)
+		if _, err := io.ReadFull(srv, q); err != nil {
+			t.Error(err)
+			return
+		}
+		srv.Write(q)
+		io.Copy(io.Discard, srv)
+	}()
+	start := time.Now()
+	l1.startTls(&tls.Config{InsecureSkipVerify: true})
+	go sendWriter.Write([]byte("hello"))
+	q := make([]byte, 5)
+	if _, err := io.ReadFull(recvReader, q); err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "hello", string(q))
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("switch took %v", d)
+	}
+	l1.close()
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1),
+		DNSNames:  []string{"example.com"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -4,10 +4,10 @@
 package xmpp
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io"
-	"log"
 	"reflect"
 	"strings"
 )
@@ -18,24 +18,51 @@ func (cl *Client) recvXml(r io.Reader, ch chan<- interface{},
 	extStanza map[xml.Name]reflect.Type) {
 
 	defer close(ch)
+	// Whoever is writing to us should stop once we do.
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
 
 	// This trick loads our namespaces into the parser.
 	nsstr := fmt.Sprintf(`<a xmlns="%s" xmlns:stream="%s">`,
 		NsClient, NsStream)
 	nsrdr := strings.NewReader(nsstr)
-	p := xml.NewDecoder(io.MultiReader(nsrdr, r))
+	var in io.Reader = io.MultiReader(nsrdr, r)
+	// If we're tracing, keep what's read until it's been parsed.
+	var tr *traceReader
+	if cl.tracer != nil {
+		tr = &traceReader{r: in}
+		in = tr
+	}
+	p := xml.NewDecoder(in)
 	p.Token()
+	traced := func() {
+		if tr != nil {
+			cl.trace(TraceRecv, tr.take(p.InputOffset()))
+		}
+	}
+	if tr != nil {
+		// Skip the namespace trick.
+		tr.take(p.InputOffset())
+	}
 
 Loop:
 	for {
 		// Sniff the next token on the stream.
 		t, err := p.Token()
 		if t == nil {
-			if err != io.EOF {
+			if err != io.EOF && !cl.closing() {
 				cl.setError(fmt.Errorf("recv: %v", err))
 			}
 			break
 		}
+		if ee, ok := t.(xml.EndElement); ok &&
+			ee.Name == (xml.Name{Space: NsStream, Local: "stream"}) {
+			// The server has ended its stream.
+			traced()
+			ch <- &streamEnd{}
+			break
+		}
 		var se xml.StartElement
 		var ok bool
 		if se, ok = t.(xml.StartElement); !ok {
@@ -51,6 +78,7 @@ Loop:
 				cl.setError(fmt.Errorf("recv: %v", err))
 				break Loop
 			}
+			traced()
 			ch <- st
 			continue
 		case "stream error", NsStream + " error":
@@ -70,10 +98,6 @@ Loop:
 			obj = &Presence{}
 		default:
 			obj = &Generic{}
-			if Debug {
-				log.Printf("Ignoring unrecognized: %s %s",
-					se.Name.Space, se.Name.Local)
-			}
 		}
 
 		// Read the complete XML stanza.
@@ -82,11 +106,13 @@ Loop:
 			cl.setError(fmt.Errorf("recv: %v", err))
 			break Loop
 		}
+		traced()
 
 		// If it's a Stanza, we try to unmarshal its innerxml
 		// into objects of the appropriate respective
 		// types. This is specified by our extensions.
 		if st, ok := obj.(Stanza); ok {
+			cl.stats().CountStanza(TraceRecv, stanzaKind(st))
 			err = parseExtended(st.GetHeader(), extStanza)
 			if err != nil {
 				cl.setError(fmt.Errorf("recv: %v", err))
@@ -139,21 +165,44 @@ func (cl *Client) sendXml(w io.Writer, ch <-chan interface{}) {
 		}
 	}(w)
 
-	enc := xml.NewEncoder(w)
+	// Each element is marshaled in full before it's written, so
+	// it can be traced.
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
 
+	var err error
 	for obj := range ch {
-		if st, ok := obj.(*stream); ok {
-			_, err := w.Write([]byte(st.String()))
-			if err != nil {
-				cl.setError(fmt.Errorf("send: %v", err))
-				break
-			}
-		} else {
-			err := enc.Encode(obj)
-			if err != nil {
-				cl.setError(fmt.Errorf("send: %v", err))
-				break
-			}
+		if err != nil {
+			// Discard anything else until the channel
+			// is closed, so nobody blocks sending to us.
+			continue
+		}
+		buf.Reset()
+		switch obj := obj.(type) {
+		case *stream:
+			buf.WriteString(obj.String())
+		case *streamEnd:
+			buf.WriteString("</stream:stream>")
+		case *whitespace:
+			buf.WriteString(" ")
+		default:
+			err = enc.Encode(obj)
+		}
+		if err == nil {
+			cl.trace(TraceSend, buf.Bytes())
+			_, err = w.Write(buf.Bytes())
+		}
+		if st, ok := obj.(Stanza); ok && err == nil {
+			cl.stats().CountStanza(TraceSend, stanzaKind(st))
+		}
+		if err != nil && !cl.closing() {
+			cl.setError(fmt.Errorf("send: %v", err))
 		}
 	}
 }
+
+// Reports whether the connection has been deliberately closed, in
+// which case errors from reading or writing it are expected.
+func (cl *Client) closing() bool {
+	return cl.layer1 != nil && cl.layer1.isClosed()
+}
@@ -6,13 +6,97 @@ package xmpp
 import (
 	"encoding/xml"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 )
 
-// Callback to handle a stanza with a particular id.
+// Callback to handle the reply to an iq with a particular id.
 type callback struct {
 	id string
+	// Where the request was sent.
+	to JID
 	f  func(Stanza)
+	// When the callback was set, and when it expires.
+	set, expires time.Time
+}
+
+// The callbacks waiting for replies, and a timer for the next one to
+// expire.
+type callbacks struct {
+	byId  map[string]*callback
+	timer *time.Timer
+}
+
+func (cbs *callbacks) add(h *callback) {
+	cbs.byId[h.id] = h
+}
+
+// Remove and return the callback for a stanza, if the stanza is a
+// reply from the entity the request was sent to.
+func (cbs *callbacks) take(cl *Client, st Stanza) *callback {
+	iq, ok := st.(*Iq)
+	if !ok || (iq.Type != "result" && iq.Type != "error") {
+		return nil
+	}
+	h := cbs.byId[iq.Id]
+	if h == nil || !cl.isReplyFrom(h.to, iq.From) {
+		return nil
+	}
+	delete(cbs.byId, iq.Id)
+	return h
+}
+
+// Remove and return the callbacks which have expired by now.
+func (cbs *callbacks) expire(now time.Time) []*callback {
+	var exp []*callback
+	for id, h := range cbs.byId {
+		if !h.expires.After(now) {
+			exp = append(exp, h)
+			delete(cbs.byId, id)
+		}
+	}
+	return exp
+}
+
+// Set the timer for the next callback to expire, and return its
+// channel.
+func (cbs *callbacks) next() <-chan time.Time {
+	var first time.Time
+	for _, h := range cbs.byId {
+		if first.IsZero() || h.expires.Before(first) {
+			first = h.expires
+		}
+	}
+	if first.IsZero() {
+		if cbs.timer != nil {
+			cbs.timer.Stop()
+		}
+		return nil
+	}
+	if cbs.timer == nil {
+		cbs.timer = time.NewTimer(time.Until(first))
+	} else {
+		cbs.timer.Reset(time.Until(first))
+	}
+	return cbs.timer.C
+}
+
+// Reports whether a reply from the given JID is acceptable as the
+// answer to a request sent to to. A request with no to, or sent to
+// our bare JID, is answered by our server on behalf of our account:
+// the reply comes from no JID or from our own. Our server may also
+// leave out its own JID. RFC 6120, Sections 8.1.2.1 and 10.3.1.
+func (cl *Client) isReplyFrom(to, from JID) bool {
+	bare := cl.Jid.Bare()
+	switch {
+	case from == to:
+		return true
+	case to == "" || to == bare:
+		return from == "" || from == bare || from == cl.Jid
+	case to == JID(cl.Jid.Domain()):
+		return from == ""
+	}
+	return false
 }
 
 // Receive XMPP stanzas from the client and send them on to the
@@ -20,16 +104,21 @@ type callback struct {
 // negotiation has completed.  This loop is paused until resource
 // binding is complete. Otherwise the app might inject something
 // inappropriate into our negotiations with the server. The control
-// channel controls this loop's activity.
-func sendStream(sendXml chan<- interface{}, recvXmpp <-chan Stanza,
-	status <-chan Status) {
-	defer close(sendXml)
+// channel controls this loop's activity. When the client closes its
+// end of the stanza stream, we end the XML stream.
+func (cl *Client) sendStream(recvXmpp <-chan Stanza, status <-chan Status) {
+	defer cl.closeRaw()
 
 	var input <-chan Stanza
 	for {
 		select {
 		case stat, ok := <-status:
-			if !ok {
+			if !ok || stat.Fatal() {
+				// Nothing more can be sent, but don't
+				// block the app until it calls Close.
+				cl.closeRaw()
+				for range recvXmpp {
+				}
 				return
 			}
 			switch stat {
@@ -40,15 +129,24 @@ func sendStream(sendXml chan<- interface{}, recvXmpp <-chan Stanza,
 			}
 		case x, ok := <-input:
 			if !ok {
+				cl.SendRaw(&streamEnd{})
 				return
 			}
 			if x == nil {
-				if Debug {
-					log.Println("Won't send nil stanza")
-				}
+				cl.logAttrs(slog.LevelDebug,
+					"dropped nil stanza",
+					stanzaAttrs(TraceSend, nil)...)
 				continue
 			}
-			sendXml <- x
+			if err := cl.ValidateStanza(x); err != nil {
+				// SendStanza refuses these, but Client.Send
+				// never did.
+				cl.logAttrs(slog.LevelWarn,
+					"sending invalid stanza",
+					append(stanzaAttrs(TraceSend, x),
+						slog.Any("err", err))...)
+			}
+			cl.SendRaw(x)
 		}
 	}
 }
@@ -60,10 +158,35 @@ func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 	defer close(sendXmpp)
 	defer cl.statmgr.close()
 
-	handlers := make(map[string]func(Stanza))
+	handlers := &callbacks{byId: make(map[string]*callback)}
+	// Nobody's left to answer the callbacks we still have, or
+	// those still on their way to us.
+	defer func() {
+		close(cl.handlersQuit)
+		cl.handlersLock.Lock()
+		cl.handlersClosed = true
+		cl.handlersLock.Unlock()
+		for _, h := range handlers.byId {
+			h.f(nil)
+		}
+		for {
+			select {
+			case h := <-cl.handlers:
+				h.f(nil)
+			default:
+				return
+			}
+		}
+	}()
 	doSend := false
+	var expire <-chan time.Time
 	for {
 		select {
+		case now := <-expire:
+			for _, h := range handlers.expire(now) {
+				h.f(nil)
+			}
+			expire = handlers.next()
 		case stat := <-status:
 			switch stat {
 			default:
@@ -72,17 +195,23 @@ func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 				doSend = true
 			}
 		case h := <-cl.handlers:
-			handlers[h.id] = h.f
+			handlers.add(h)
+			expire = handlers.next()
 		case x, ok := <-recvXml:
 			if !ok {
 				return
 			}
 			switch obj := x.(type) {
 			case *stream:
-				// Do nothing.
+				cl.streamLang = obj.Lang
 			case *streamError:
 				cl.setError(fmt.Errorf("%#v", obj))
-				return
+			case *streamEnd:
+				// Answer with our own closing tag, if
+				// we haven't already.
+				cl.SendRaw(obj)
+				cl.closeRaw()
+				cl.setStatus(StatusShutdown)
 			case *Features:
 				cl.handleFeatures(obj)
 			case *starttls:
@@ -90,20 +219,42 @@ func (cl *Client) recvStream(recvXml <-chan interface{}, sendXmpp chan<- Stanza,
 			case *auth:
 				cl.handleSasl(obj)
 			case Stanza:
-				id := obj.GetHeader().Id
-				if handlers[id] != nil {
-					f := handlers[id]
-					delete(handlers, id)
-					f(obj)
+				// Stanzas inherit the stream's default
+				// language.
+				if hdr := obj.GetHeader(); hdr.Lang == "" {
+					hdr.Lang = cl.streamLang
 				}
-				if doSend {
-					sendXmpp <- obj
+				if h := handlers.take(cl, obj); h != nil {
+					expire = handlers.next()
+					cl.stats().ObserveIqRtt(
+						time.Since(h.set))
+					h.f(obj)
 				}
-			default:
-				if Debug {
-					log.Printf("Unrecognized input: %T %#v",
-						x, x)
+				// Don't let an app which has stopped
+				// reading hold up shutting down.
+				for done := !doSend; !done; {
+					select {
+					case sendXmpp <- obj:
+						done = true
+					case stat := <-status:
+						doSend = stat == StatusRunning
+						done = !doSend
+					}
+				}
+			case *Generic:
+				if !cl.handleElement(obj) {
+					cl.logAttrs(slog.LevelDebug,
+						"unhandled element",
+						slog.String("dir", "recv"),
+						slog.String("element",
+							obj.XMLName.Space+" "+
+								obj.XMLName.Local))
 				}
+			default:
+				cl.logAttrs(slog.LevelDebug,
+					"unrecognized input",
+					slog.String("dir", "recv"),
+					slog.String("type", fmt.Sprintf("%T", x)))
 			}
 		}
 	}
@@ -114,7 +265,7 @@ func (cl *Client) handleFeatures(fe *Features) {
 	if fe.Starttls != nil {
 		start := &starttls{XMLName: xml.Name{Space: NsTLS,
 			Local: "starttls"}}
-		cl.sendRaw <- start
+		cl.SendRaw(start)
 		return
 	}
 
@@ -123,12 +274,28 @@ func (cl *Client) handleFeatures(fe *Features) {
 		return
 	}
 
+	for _, ext := range cl.exts {
+		if ext.OnFeatures != nil && ext.OnFeatures(cl, fe) {
+			return
+		}
+	}
+
 	if fe.Bind != nil {
 		cl.bind()
 		return
 	}
 }
 
+// Offer an unrecognized top-level element to the extensions.
+func (cl *Client) handleElement(el *Generic) bool {
+	for _, ext := range cl.exts {
+		if ext.OnElement != nil && ext.OnElement(cl, el) {
+			return true
+		}
+	}
+	return false
+}
+
 func (cl *Client) handleTls(t *starttls) {
 	cl.layer1.startTls(cl.tlsConfig)
 
@@ -136,7 +303,7 @@ func (cl *Client) handleTls(t *starttls) {
 
 	// Now re-send the initial handshake message to start the new
 	// session.
-	cl.sendRaw <- &stream{To: cl.Jid.Domain(), Version: XMPPVersion}
+	cl.SendRaw(cl.streamHeader())
 }
 
 // Send a request to bind a resource. RFC 3920, section 7.
@@ -146,26 +313,19 @@ func (cl *Client) bind() {
 	if res != "" {
 		bindReq.Resource = &res
 	}
-	msg := &Iq{Header: Header{Type: "set", Id: NextId(),
+	msg := &Iq{Header: Header{Type: "set", Id: cl.NextId(),
 		Nested: []interface{}{bindReq}}}
 	f := func(st Stanza) {
 		iq, ok := st.(*Iq)
 		if !ok {
-			cl.setError(fmt.Errorf("non-iq response to bind %#v",
-				st))
+			cl.setError(fmt.Errorf("no reply to bind"))
 			return
 		}
 		if iq.Type == "error" {
 			cl.setError(fmt.Errorf("Resource binding failed"))
 			return
 		}
-		var bindRepl *bindIq
-		for _, ele := range iq.Nested {
-			if b, ok := ele.(*bindIq); ok {
-				bindRepl = b
-				break
-			}
-		}
+		bindRepl := FindNested[bindIq](iq)
 		if bindRepl == nil {
 			cl.setError(fmt.Errorf("Bad bind reply: %#v", iq))
 			return
@@ -177,19 +337,90 @@ func (cl *Client) bind() {
 			return
 		}
 		cl.Jid = JID(*jid)
+		cl.tagLogger()
+		for _, ext := range cl.exts {
+			if ext.OnBound != nil {
+				ext.OnBound(cl, cl.Features)
+			}
+		}
 		cl.setStatus(StatusBound)
 	}
 	cl.SetCallback(msg.Id, f)
-	cl.sendRaw <- msg
+	cl.SendRaw(msg)
 }
 
-// Register a callback to handle the next XMPP stanza (iq, message, or
-// presence) with a given id. The provided function will not be called
-// more than once. If it returns false, the stanza will not be made
-// available on the normal Client.Recv channel. The callback must not
-// read from that channel, as deliveries on it cannot proceed until
-// the handler returns true or false.
+// Register a callback to handle the reply to an iq with the given id,
+// which was sent with no to attribute, so it's answered by our server
+// on behalf of our account. The callback is called once, with the iq
+// result or error, or with nil if the stream ends or no reply arrives
+// within the callback timeout (see WithCallbackTimeout). Other stanzas
+// with the same id are ignored. The reply is also made available on
+// the normal Client.Recv channel. The callback must not read from that
+// channel, as deliveries on it cannot proceed until the callback
+// returns.
 func (cl *Client) SetCallback(id string, f func(Stanza)) {
-	h := &callback{id: id, f: f}
-	cl.handlers <- h
+	cl.setCallback("", id, f)
+}
+
+// Like SetCallback, for an iq which may have been sent to any
+// entity. Only a reply from that entity is accepted.
+func (cl *Client) SetIqCallback(iq *Iq, f func(Stanza)) {
+	cl.setCallback(iq.To, iq.Id, f)
+}
+
+// Send an iq with SendStanza and wait for the reply, which is
+// returned whether it's a result or an error. If there's no reply,
+// ErrNoReply is returned.
+func (cl *Client) request(iq *Iq) (*Iq, error) {
+	reply := make(chan Stanza, 1)
+	cl.SetIqCallback(iq, func(st Stanza) { reply <- st })
+	if err := cl.SendStanza(iq); err != nil {
+		return nil, err
+	}
+	res, ok := (<-reply).(*Iq)
+	if !ok {
+		return nil, ErrNoReply
+	}
+	return res, nil
+}
+
+func (cl *Client) setCallback(to JID, id string, f func(Stanza)) {
+	now := time.Now()
+	h := &callback{id: id, to: to, f: f, set: now,
+		expires: now.Add(cl.replyTimeout())}
+	if !cl.addCallback(h) {
+		// No reply can arrive now.
+		f(nil)
+	}
+}
+
+// Hand a callback to recvStream. Returns false if it has stopped.
+func (cl *Client) addCallback(h *callback) bool {
+	cl.handlersLock.RLock()
+	defer cl.handlersLock.RUnlock()
+	if cl.handlersClosed {
+		return false
+	}
+	select {
+	case cl.handlers <- h:
+		return true
+	case <-cl.handlersQuit:
+		return false
+	}
+}
+
+// How long to wait for a reply. See WithCallbackTimeout.
+func (cl *Client) replyTimeout() time.Duration {
+	if cl.callbackTimeout == 0 {
+		return DefaultCallbackTimeout
+	}
+	return cl.callbackTimeout
+}
+
+// WithCallbackTimeout sets how long callbacks set with SetCallback
+// and SetIqCallback wait for a reply.
+func WithCallbackTimeout(d time.Duration) Option {
+	return func(cl *Client) {
+		cl.callbackTimeout = d
+	}
 }
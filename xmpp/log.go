@@ -0,0 +1,62 @@
+package xmpp
+
+// This file contains support for the client's internal diagnostics,
+// which are logged with log/slog.
+
+import (
+	"context"
+	"log/slog"
+)
+
+// WithLogger sets the logger for the client's diagnostics. By
+// default, slog.Default() is used. Each message carries the client's
+// JID and the current negotiation phase; input which is dropped or
+// not understood is logged at debug level.
+func WithLogger(l *slog.Logger) Option {
+	return func(cl *Client) {
+		cl.log = l
+	}
+}
+
+func (cl *Client) logger() *slog.Logger {
+	if l := cl.jidLog.Load(); l != nil {
+		return l
+	}
+	if cl.log == nil {
+		return slog.Default()
+	}
+	return cl.log
+}
+
+// Tag what we log with our JID, as it is now.
+func (cl *Client) tagLogger() {
+	l := cl.log
+	if l == nil {
+		l = slog.Default()
+	}
+	cl.jidLog.Store(l.With(slog.String("jid", string(cl.Jid))))
+}
+
+// Log a message, adding the negotiation phase to its attributes.
+func (cl *Client) logAttrs(level slog.Level, msg string,
+	attrs ...slog.Attr) {
+
+	l := cl.logger()
+	ctx := context.Background()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+	attrs = append(attrs, slog.String("phase", cl.status().String()))
+	l.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// Attributes describing a stanza and the direction it's travelling.
+func stanzaAttrs(dir TraceDir, st Stanza) []slog.Attr {
+	attrs := []slog.Attr{slog.String("dir", dir.String())}
+	if st != nil {
+		hdr := st.GetHeader()
+		attrs = append(attrs, slog.String("kind", stanzaKind(st)),
+			slog.String("id", hdr.Id))
+	}
+	return attrs
+}
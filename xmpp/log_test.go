@@ -0,0 +1,109 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLogInvalidStanza(t *testing.T) {
+	var lock sync.Mutex
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(lockedWriter{&lock, &buf},
+		&slog.HandlerOptions{Level: slog.LevelDebug})
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client(WithLogger(slog.New(h)))
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	bad := &Message{Header: Header{Id: "bad",
+		Nested: []interface{}{"string"}}}
+	if err := cl.SendStanza(bad); err == nil {
+		t.Error("SendStanza accepted invalid stanza")
+	}
+	// Client.Send passes it through.
+	cl.Send <- bad
+	if e := fs.next(); e.attr("id") != "bad" {
+		t.Fatalf("server got %s", e.attr("id"))
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	var rec map[string]interface{}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "sending invalid stanza") {
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if rec == nil {
+		t.Fatalf("no log record in %s", buf.String())
+	}
+	want := map[string]interface{}{
+		"level": "WARN",
+		"jid":   "user@example.com/res",
+		"phase": "running",
+		"dir":   "send",
+		"kind":  "message",
+		"id":    "bad",
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("%s: got %v, want %v", k, rec[k], v)
+		}
+	}
+}
+
+func TestLogBoundJid(t *testing.T) {
+	var lock sync.Mutex
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(lockedWriter{&lock, &buf},
+		&slog.HandlerOptions{Level: slog.LevelDebug})
+	fs := newFakeServer(t)
+	defer fs.close()
+	// The server picks a resource other than the one we asked for.
+	fs.handle = func(fs *fakeServer, e *rawElem) bool {
+		if e.XMLName.Local != "iq" || !strings.Contains(e.Inner, NsBind) {
+			return false
+		}
+		fs.write(fmt.Sprintf(`<iq type="result" id="%s">`+
+			`<bind xmlns="%s"><jid>user@example.com/other`+
+			`</jid></bind></iq>`, e.attr("id"), NsBind))
+		return true
+	}
+	cl := fs.client(WithLogger(slog.New(h)))
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	lock.Lock()
+	defer lock.Unlock()
+	jids := make(map[string]string)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		var rec map[string]interface{}
+		if json.Unmarshal([]byte(line), &rec) != nil ||
+			rec["msg"] != "status change" {
+			continue
+		}
+		status, _ := rec["status"].(string)
+		jids[status], _ = rec["jid"].(string)
+	}
+	if jids["connected"] != "user@example.com/res" {
+		t.Errorf("before bind: %q", jids["connected"])
+	}
+	if jids["running"] != "user@example.com/other" {
+		t.Errorf("after bind: %q", jids["running"])
+	}
+}
+
+func TestStatusString(t *testing.T) {
+	assertEquals(t, "running", StatusRunning.String())
+	assertEquals(t, "Status(42)", Status(42).String())
+}
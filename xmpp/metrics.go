@@ -0,0 +1,136 @@
+package xmpp
+
+// This file contains hooks for measuring a client's activity, and an
+// implementation which publishes the measurements with expvar.
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Metrics receives measurements of a client's activity. Its methods
+// are called from the client's internal goroutines, possibly
+// concurrently, and must not block. One Metrics may be shared by
+// several clients.
+type Metrics interface {
+	// A stanza was sent or received. kind is "iq", "message" or
+	// "presence".
+	CountStanza(dir TraceDir, kind string)
+	// An iq was answered, d after a callback was set for it with
+	// SetCallback or SetIqCallback.
+	ObserveIqRtt(d time.Duration)
+	// The client spent d in status from, then moved to status
+	// to. The time spent in StatusConnected, for instance, is
+	// the time taken to negotiate TLS.
+	ObserveStatus(from, to Status, d time.Duration)
+	// The number of stanzas waiting in the send queue changed by
+	// delta.
+	AddQueued(delta int)
+}
+
+// WithMetrics has the client report measurements of its activity to
+// m.
+func WithMetrics(m Metrics) Option {
+	return func(cl *Client) {
+		cl.metrics = m
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) CountStanza(TraceDir, string)                {}
+func (nopMetrics) ObserveIqRtt(time.Duration)                  {}
+func (nopMetrics) ObserveStatus(Status, Status, time.Duration) {}
+func (nopMetrics) AddQueued(int)                               {}
+
+func (cl *Client) stats() Metrics {
+	if cl.metrics == nil {
+		return nopMetrics{}
+	}
+	return cl.metrics
+}
+
+// The upper bounds of the buckets of the histograms published by
+// ExpvarMetrics.
+var DefaultBuckets = []time.Duration{
+	10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second,
+}
+
+// ExpvarMetrics publishes a client's measurements as an expvar.Map
+// with these members:
+//
+//	sent, recv   maps from stanza kind to count
+//	iq_rtt       histogram of iq round trip times
+//	status       map from status name to a histogram of the time
+//	             spent in that status
+//	queued       stanzas waiting in the send queue
+//
+// Each histogram is a map holding the number of observations
+// ("count"), their sum in seconds ("sum"), and a cumulative count for
+// each bucket, keyed by its upper bound ("le_100ms", ..., "le_inf").
+type ExpvarMetrics struct {
+	sent, recv *expvar.Map
+	iqRtt      *expvar.Map
+	status     *expvar.Map
+	queued     *expvar.Int
+	// Protects the creation of status histograms.
+	lock sync.Mutex
+}
+
+// NewExpvarMetrics publishes a new set of metrics under the given
+// name. Like expvar.Publish, it panics if the name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := &ExpvarMetrics{sent: new(expvar.Map), recv: new(expvar.Map),
+		iqRtt: new(expvar.Map), status: new(expvar.Map),
+		queued: new(expvar.Int)}
+	top := expvar.NewMap(name)
+	top.Set("sent", m.sent)
+	top.Set("recv", m.recv)
+	top.Set("iq_rtt", m.iqRtt)
+	top.Set("status", m.status)
+	top.Set("queued", m.queued)
+	return m
+}
+
+func (m *ExpvarMetrics) CountStanza(dir TraceDir, kind string) {
+	if dir == TraceSend {
+		m.sent.Add(kind, 1)
+	} else {
+		m.recv.Add(kind, 1)
+	}
+}
+
+func (m *ExpvarMetrics) ObserveIqRtt(d time.Duration) {
+	observe(m.iqRtt, d)
+}
+
+func (m *ExpvarMetrics) ObserveStatus(from, to Status, d time.Duration) {
+	m.lock.Lock()
+	hist, ok := m.status.Get(from.String()).(*expvar.Map)
+	if !ok {
+		hist = new(expvar.Map)
+		m.status.Set(from.String(), hist)
+	}
+	m.lock.Unlock()
+	observe(hist, d)
+}
+
+func (m *ExpvarMetrics) AddQueued(delta int) {
+	m.queued.Add(int64(delta))
+}
+
+// Add an observation to a histogram.
+func observe(hist *expvar.Map, d time.Duration) {
+	hist.Add("count", 1)
+	hist.AddFloat("sum", d.Seconds())
+	for _, b := range DefaultBuckets {
+		if d <= b {
+			hist.Add("le_"+b.String(), 1)
+		}
+	}
+	hist.Add("le_inf", 1)
+}
@@ -0,0 +1,111 @@
+package xmpp
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMetrics struct {
+	lock     sync.Mutex
+	stanzas  map[string]int
+	rtts     int
+	statuses []Status
+	queued   int
+}
+
+func (m *testMetrics) CountStanza(dir TraceDir, kind string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stanzas[dir.String()+" "+kind]++
+}
+
+func (m *testMetrics) ObserveIqRtt(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rtts++
+}
+
+func (m *testMetrics) ObserveStatus(from, to Status, d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.statuses = append(m.statuses, from)
+}
+
+func (m *testMetrics) AddQueued(delta int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.queued += delta
+}
+
+func TestMetrics(t *testing.T) {
+	m := &testMetrics{stanzas: make(map[string]int)}
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client(WithMetrics(m))
+	drain(cl)
+	fs.next()
+	cl.Close()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// Bind, session and roster.
+	if m.stanzas["send iq"] != 3 || m.stanzas["recv iq"] != 3 {
+		t.Errorf("stanzas %v", m.stanzas)
+	}
+	if m.stanzas["send presence"] != 2 {
+		t.Errorf("stanzas %v", m.stanzas)
+	}
+	if m.rtts < 2 {
+		t.Errorf("%d iq round trips", m.rtts)
+	}
+	want := []Status{StatusUnconnected, StatusConnected,
+		StatusAuthenticated, StatusBound, StatusRunning}
+	if len(m.statuses) < len(want) {
+		t.Fatalf("statuses %v", m.statuses)
+	}
+	for i, s := range want {
+		if m.statuses[i] != s {
+			t.Errorf("statuses %v", m.statuses)
+			break
+		}
+	}
+	if m.queued != 0 {
+		t.Errorf("%d still queued", m.queued)
+	}
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	// Names can't be reused, even when the test is.
+	name := fmt.Sprintf("xmpp_test_%d", time.Now().UnixNano())
+	m := NewExpvarMetrics(name)
+	m.CountStanza(TraceSend, "iq")
+	m.CountStanza(TraceRecv, "message")
+	m.ObserveIqRtt(200 * time.Millisecond)
+	m.ObserveStatus(StatusConnected, StatusConnectedTls, time.Second)
+	m.AddQueued(2)
+
+	var got struct {
+		Sent, Recv map[string]int
+		IqRtt      map[string]float64 `json:"iq_rtt"`
+		Status     map[string]map[string]float64
+		Queued     int
+	}
+	err := json.Unmarshal([]byte(expvar.Get(name).String()), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Sent["iq"] != 1 || got.Recv["message"] != 1 || got.Queued != 2 {
+		t.Errorf("got %+v", got)
+	}
+	if got.IqRtt["le_100ms"] != 0 || got.IqRtt["le_250ms"] != 1 ||
+		got.IqRtt["le_inf"] != 1 || got.IqRtt["count"] != 1 {
+		t.Errorf("iq_rtt %v", got.IqRtt)
+	}
+	if got.Status["connected"]["sum"] != 1 {
+		t.Errorf("status %v", got.Status)
+	}
+}
@@ -0,0 +1,687 @@
+package xmpp
+
+// This file contains support for multi-user chat, XEP-0045.
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// Returned by MUC.Join when we're already in the room.
+	ErrAlreadyJoined = errors.New("xmpp: already in room")
+	// Matches a MUCError for a nickname which is taken, with
+	// errors.Is.
+	ErrNickConflict = errors.New("xmpp: nickname in use")
+)
+
+// The element which asks to join a room. XEP-0045, Section 7.2.
+type MUCJoin struct {
+	XMLName  xml.Name `xml:"http://jabber.org/protocol/muc x"`
+	Password string   `xml:"password,omitempty"`
+	History  *History `xml:"history"`
+}
+
+// Limits on the discussion history sent when we join a room. Nil
+// fields are left to the room. XEP-0045, Section 7.2.13.
+type History struct {
+	MaxChars   *int       `xml:"maxchars,attr,omitempty"`
+	MaxStanzas *int       `xml:"maxstanzas,attr,omitempty"`
+	Seconds    *int       `xml:"seconds,attr,omitempty"`
+	Since      *time.Time `xml:"since,attr,omitempty"`
+}
+
+// Information about an occupant, carried in the room's presences.
+// XEP-0045, Section 7.2.3.
+type MUCUser struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
+	Item    []MUCItem   `xml:"item"`
+	Status  []MUCStatus `xml:"status"`
+	// Invitations, and their refusal. See mucinvite.go.
+	Invite   []MUCInvite `xml:"invite"`
+	Decline  *MUCInvite  `xml:"decline"`
+	Password string      `xml:"password,omitempty"`
+}
+
+// An occupant's role and affiliation, and the reason for a change to
+// them.
+type MUCItem struct {
+	XMLName     xml.Name  `xml:"item"`
+	Affiliation string    `xml:"affiliation,attr,omitempty"`
+	Role        string    `xml:"role,attr,omitempty"`
+	Jid         JID       `xml:"jid,attr,omitempty"`
+	Nick        string    `xml:"nick,attr,omitempty"`
+	Actor       *MUCActor `xml:"actor"`
+	Reason      string    `xml:"reason,omitempty"`
+}
+
+// Who made a change to an occupant.
+type MUCActor struct {
+	Jid  JID    `xml:"jid,attr,omitempty"`
+	Nick string `xml:"nick,attr,omitempty"`
+}
+
+// A status code. XEP-0045, Section 15.6.
+type MUCStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+// Status codes we act on.
+const (
+	// The presence is our own.
+	MUCStatusSelf = 110
+	// The room was created by our joining it.
+	MUCStatusCreated = 201
+	// The occupant is banned.
+	MUCStatusBanned = 301
+	// The occupant changed nickname.
+	MUCStatusNickChanged = 303
+	// The occupant was kicked.
+	MUCStatusKicked = 307
+	// The occupant was removed because their affiliation changed.
+	MUCStatusAffiliationChanged = 321
+	// The occupant was removed because the room is now members
+	// only.
+	MUCStatusMembersOnly = 322
+	// The occupant was removed because the service is shutting
+	// down.
+	MUCStatusShutdown = 332
+)
+
+// MUCError is returned when a room refuses to let us join, or refuses
+// some other request. Condition is one of the stanza error conditions
+// of RFC 6120, Section 8.3.3. For instance, "conflict" means our
+// nickname is taken, "not-authorized" that a password is needed, and
+// "forbidden" that we're banned. XEP-0045, Section 7.2.
+type MUCError struct {
+	Room      JID
+	Condition string
+	// The error returned by the room.
+	Err *Error
+}
+
+func (e *MUCError) Error() string {
+	return fmt.Sprintf("room %s: %s", e.Room, e.Condition)
+}
+
+func (e *MUCError) Unwrap() error {
+	if e.Err == nil {
+		return nil
+	}
+	return e.Err
+}
+
+func (e *MUCError) Is(target error) bool {
+	return target == ErrNickConflict && e.Condition == "conflict"
+}
+
+// An occupant of a room.
+type Occupant struct {
+	Nick string
+	// The occupant's real JID, if the room tells us.
+	Jid         JID
+	Role        string
+	Affiliation string
+	// The occupant's latest presence in the room.
+	Presence *Presence
+}
+
+// The kind of change a RoomEvent reports.
+type RoomEventType int
+
+const (
+	// An occupant joined the room.
+	OccupantJoined RoomEventType = iota
+	// An occupant's presence, role, or affiliation changed.
+	OccupantChanged
+	// An occupant changed nickname.
+	OccupantNickChanged
+	// An occupant left the room of their own accord.
+	OccupantLeft
+	// An occupant was kicked.
+	OccupantKicked
+	// An occupant was banned.
+	OccupantBanned
+	// An occupant was removed for another reason, such as the
+	// room becoming members only. See the event's Codes.
+	OccupantRemoved
+	// We found we'd dropped out of the room, and are rejoining.
+	// See WithMUCSelfPing.
+	RoomDisconnected
+	// We're back in the room.
+	RoomRejoined
+	// The room refused to let us back in, so we've left it.
+	RoomRejoinFailed
+)
+
+func (t RoomEventType) String() string {
+	switch t {
+	case OccupantJoined:
+		return "joined"
+	case OccupantChanged:
+		return "changed"
+	case OccupantNickChanged:
+		return "nick-changed"
+	case OccupantLeft:
+		return "left"
+	case OccupantKicked:
+		return "kicked"
+	case OccupantBanned:
+		return "banned"
+	case OccupantRemoved:
+		return "removed"
+	case RoomDisconnected:
+		return "disconnected"
+	case RoomRejoined:
+		return "rejoined"
+	case RoomRejoinFailed:
+		return "rejoin-failed"
+	}
+	return fmt.Sprintf("RoomEventType(%d)", int(t))
+}
+
+// A change in a room's occupants. Occupant is the occupant as it is
+// now, or as it was when it left. Old is the occupant before a change
+// or a change of nickname, and is empty otherwise.
+type RoomEvent struct {
+	Type     RoomEventType
+	Occupant Occupant
+	Old      Occupant
+	// Whether the occupant is us.
+	Self bool
+	// The status codes of the presence.
+	Codes []int
+	// The reason given for a kick, ban or other change, if any.
+	Reason string
+}
+
+// Options for joining a room.
+type JoinOptions struct {
+	// The room's password, if it has one.
+	Password string
+	// How much history we'd like. If nil, it's up to the room.
+	History *History
+}
+
+// A room we've joined. Its methods may be called from any goroutine.
+// Once we've left the room, they behave as if it were empty.
+type Room struct {
+	// The room's bare JID.
+	Jid JID
+	m   *MUC
+}
+
+// MUC manages the multi-user chat rooms we're in. The room's messages
+// and presences are still delivered on Client.Recv.
+type MUC struct {
+	Extension
+	// Functions to run against the manager's rooms.
+	ops chan func(map[JID]*roomState)
+	// Closed when the manager stops.
+	done chan struct{}
+	cl   *Client
+}
+
+// What the manager knows about a room.
+type roomState struct {
+	nick    string
+	opts    JoinOptions
+	joined  bool
+	created bool
+	// Told the result of joining, while we're waiting for it.
+	joining chan error
+	// Whether we're joining again after dropping out.
+	rejoining bool
+	// When we last knew we were in the room.
+	lastSeen time.Time
+	// Closed once we've left, while we're waiting to.
+	leaving   chan struct{}
+	occupants map[string]Occupant
+	subs      []*subscriber[RoomEvent]
+}
+
+func hasStatus(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Forget a room, and tell anyone waiting on it.
+func (st *roomState) end(err error) {
+	if st.joining != nil {
+		if err == nil {
+			err = ErrNoReply
+		}
+		st.joining <- err
+		st.joining = nil
+	}
+	if st.leaving != nil {
+		close(st.leaving)
+		st.leaving = nil
+	}
+	for _, s := range st.subs {
+		s.close()
+	}
+	st.subs = nil
+}
+
+func (m *MUC) mucMgr(upd <-chan Stanza) {
+	defer close(m.done)
+	rooms := make(map[JID]*roomState)
+	defer func() {
+		for _, st := range rooms {
+			st.end(ErrClosed)
+		}
+	}()
+	for {
+		select {
+		case f := <-m.ops:
+			f(rooms)
+
+		case stan, ok := <-upd:
+			if !ok {
+				return
+			}
+			pr, ok := stan.(*Presence)
+			if !ok {
+				continue
+			}
+			jid := pr.From.Bare()
+			st := rooms[jid]
+			if st == nil {
+				continue
+			}
+			if st.handlePresence(jid, pr) {
+				delete(rooms, jid)
+			}
+		}
+	}
+}
+
+// Update a room from one of its presences. Returns true if we're no
+// longer in the room.
+func (st *roomState) handlePresence(room JID, pr *Presence) bool {
+	nick := pr.From.Resource()
+	if pr.Type == "error" {
+		if st.joining == nil || nick != st.nick {
+			return false
+		}
+		err := &MUCError{Room: room, Err: pr.Error}
+		if pr.Error != nil {
+			err.Condition = pr.Error.Condition()
+		}
+		if st.rejoining {
+			st.subs = publish(st.subs, []RoomEvent{{
+				Type: RoomRejoinFailed, Self: true}})
+		}
+		st.end(err)
+		return true
+	}
+	if pr.Type != "" && pr.Type != "unavailable" {
+		return false
+	}
+	occ := Occupant{Nick: nick, Presence: pr}
+	ev := RoomEvent{}
+	if x := FindNested[MUCUser](pr); x != nil {
+		for _, s := range x.Status {
+			ev.Codes = append(ev.Codes, s.Code)
+		}
+		if len(x.Item) > 0 {
+			item := x.Item[0]
+			occ.Jid = item.Jid
+			occ.Role = item.Role
+			occ.Affiliation = item.Affiliation
+			ev.Reason = item.Reason
+		}
+	}
+	ev.Self = hasStatus(ev.Codes, MUCStatusSelf) || nick == st.nick
+	old, had := st.occupants[nick]
+	gone := false
+	if pr.Type == "unavailable" {
+		delete(st.occupants, nick)
+		ev.Occupant = occ
+		switch {
+		case hasStatus(ev.Codes, MUCStatusNickChanged):
+			x := FindNested[MUCUser](pr)
+			if x == nil || len(x.Item) == 0 {
+				return false
+			}
+			// The occupant will be back under the new
+			// nickname.
+			ev.Type = OccupantNickChanged
+			ev.Old = old
+			ev.Occupant.Nick = x.Item[0].Nick
+			st.occupants[ev.Occupant.Nick] = ev.Occupant
+			if ev.Self {
+				st.nick = ev.Occupant.Nick
+			}
+		case hasStatus(ev.Codes, MUCStatusBanned):
+			ev.Type = OccupantBanned
+		case hasStatus(ev.Codes, MUCStatusKicked):
+			ev.Type = OccupantKicked
+		case hasStatus(ev.Codes, MUCStatusAffiliationChanged),
+			hasStatus(ev.Codes, MUCStatusMembersOnly),
+			hasStatus(ev.Codes, MUCStatusShutdown):
+			ev.Type = OccupantRemoved
+		default:
+			ev.Type = OccupantLeft
+		}
+		gone = ev.Self && ev.Type != OccupantNickChanged
+	} else {
+		st.occupants[nick] = occ
+		ev.Occupant = occ
+		ev.Type = OccupantJoined
+		if had {
+			ev.Type = OccupantChanged
+			ev.Old = old
+		}
+		if ev.Self {
+			// The room may have changed our nickname.
+			st.nick = nick
+			st.joined = true
+			st.lastSeen = time.Now()
+			if hasStatus(ev.Codes, MUCStatusCreated) {
+				st.created = true
+			}
+			if st.joining != nil {
+				st.joining <- nil
+				st.joining = nil
+			}
+		}
+	}
+	evs := []RoomEvent{ev}
+	if ev.Self && st.rejoining && pr.Type == "" {
+		st.rejoining = false
+		evs = append(evs, RoomEvent{Type: RoomRejoined,
+			Occupant: occ, Self: true})
+	}
+	st.subs = publish(st.subs, evs)
+	if gone {
+		st.end(nil)
+	}
+	return gone
+}
+
+func (m *MUC) makeFilter() Filter {
+	mucUpdate := make(chan Stanza)
+	go m.mucMgr(mucUpdate)
+	return func(in <-chan Stanza, out chan<- Stanza) {
+		defer close(out)
+		defer close(mucUpdate)
+		for stan := range in {
+			if _, ok := stan.(*Presence); ok {
+				mucUpdate <- stan
+			}
+			out <- stan
+		}
+	}
+}
+
+func newMUCExt() *MUC {
+	m := MUC{}
+	RegisterPayload[MUCJoin](&m.Extension)
+	RegisterPayload[MUCUser](&m.Extension)
+	RegisterPayload[MUCAdminQuery](&m.Extension)
+	RegisterPayload[MUCOwnerQuery](&m.Extension)
+	RegisterPayload[DirectInvite](&m.Extension)
+	m.ops = make(chan func(map[JID]*roomState))
+	m.done = make(chan struct{})
+	m.RecvFilter = m.makeFilter()
+	m.RecvInterceptor = m.interceptInvite
+	m.OnRunning = func(cl *Client) {
+		if cl.mucPingInterval > 0 {
+			status := cl.statmgr.newListener()
+			cl.spawn(func() { m.selfPingLoop(status) })
+		}
+	}
+	return &m
+}
+
+// Run f against the manager's rooms. Returns false if the manager has
+// stopped.
+func (m *MUC) query(f func(map[JID]*roomState)) bool {
+	done := make(chan struct{})
+	select {
+	case m.ops <- func(rooms map[JID]*roomState) {
+		f(rooms)
+		close(done)
+	}:
+		<-done
+		return true
+	case <-m.done:
+		return false
+	}
+}
+
+// Join enters a room, under the given nickname, and waits for the
+// room to let us in. The room's JID may be bare, or include the
+// nickname, in which case nick may be empty. If the room refuses, a
+// *MUCError is returned; if the nickname is taken, it matches
+// ErrNickConflict. opts may be nil. XEP-0045, Section 7.2.
+func (m *MUC) Join(room JID, nick string, opts *JoinOptions) (*Room, error) {
+	if nick == "" {
+		nick = room.Resource()
+	}
+	room = room.Bare()
+	if opts == nil {
+		opts = &JoinOptions{}
+	}
+	if room.Node() == "" || nick == "" {
+		return nil, &MUCError{Room: room, Condition: "jid-malformed"}
+	}
+	result := make(chan error, 1)
+	var err error
+	ok := m.query(func(rooms map[JID]*roomState) {
+		if rooms[room] != nil {
+			err = ErrAlreadyJoined
+			return
+		}
+		rooms[room] = &roomState{nick: nick, opts: *opts,
+			joining: result, occupants: make(map[string]Occupant)}
+	})
+	if !ok {
+		return nil, ErrClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := m.sendJoin(room, nick, opts); err != nil {
+		m.abandon(room, result)
+		return nil, err
+	}
+	t := time.NewTimer(m.cl.replyTimeout())
+	defer t.Stop()
+	select {
+	case err := <-result:
+		if err != nil {
+			return nil, err
+		}
+		return &Room{Jid: room, m: m}, nil
+	case <-t.C:
+		m.abandon(room, result)
+		return nil, ErrNoReply
+	}
+}
+
+func (m *MUC) sendJoin(room JID, nick string, opts *JoinOptions) error {
+	cl := m.cl
+	x := &MUCJoin{Password: opts.Password, History: opts.History}
+	pr := &Presence{Header: Header{To: room + "/" + JID(nick),
+		Id: cl.NextId(), Nested: []interface{}{x}}}
+	return cl.SendStanza(pr)
+}
+
+// Give up on joining a room, unless the attempt has since finished.
+func (m *MUC) abandon(room JID, result chan error) {
+	m.query(func(rooms map[JID]*roomState) {
+		if st := rooms[room]; st != nil && st.joining == result {
+			st.joining = nil
+			st.end(nil)
+			delete(rooms, room)
+		}
+	})
+}
+
+// Rooms returns the rooms we're in.
+func (m *MUC) Rooms() []*Room {
+	var rs []*Room
+	m.query(func(rooms map[JID]*roomState) {
+		for jid, st := range rooms {
+			if st.joined {
+				rs = append(rs, &Room{Jid: jid, m: m})
+			}
+		}
+	})
+	return rs
+}
+
+// Room returns the room with the given bare JID, if we're in it.
+func (m *MUC) Room(jid JID) (*Room, bool) {
+	var ok bool
+	m.query(func(rooms map[JID]*roomState) {
+		st := rooms[jid]
+		ok = st != nil && st.joined
+	})
+	if !ok {
+		return nil, false
+	}
+	return &Room{Jid: jid, m: m}, true
+}
+
+// Run f against the room's state, if we're still in it.
+func (r *Room) query(f func(st *roomState)) {
+	r.m.query(func(rooms map[JID]*roomState) {
+		if st := rooms[r.Jid]; st != nil {
+			f(st)
+		}
+	})
+}
+
+// Nick returns our nickname in the room.
+func (r *Room) Nick() string {
+	var nick string
+	r.query(func(st *roomState) { nick = st.nick })
+	return nick
+}
+
+// Joined reports whether we're still in the room.
+func (r *Room) Joined() bool {
+	var joined bool
+	r.query(func(st *roomState) { joined = st.joined })
+	return joined
+}
+
+// Created reports whether the room was created by our joining it.
+// Until it's configured, nobody else can join. XEP-0045, Section 10.1.
+func (r *Room) Created() bool {
+	var created bool
+	r.query(func(st *roomState) { created = st.created })
+	return created
+}
+
+// Occupants returns the room's occupants, including us.
+func (r *Room) Occupants() []Occupant {
+	var occs []Occupant
+	r.query(func(st *roomState) {
+		for _, occ := range st.occupants {
+			occs = append(occs, occ)
+		}
+	})
+	return occs
+}
+
+// Occupant returns the occupant with the given nickname, and whether
+// there is one.
+func (r *Room) Occupant(nick string) (Occupant, bool) {
+	var occ Occupant
+	var ok bool
+	r.query(func(st *roomState) { occ, ok = st.occupants[nick] })
+	return occ, ok
+}
+
+// Subscribe returns a channel on which changes to the room's
+// occupants are delivered, starting with an OccupantJoined event for
+// each occupant already known. Events are queued for as long as the
+// caller takes to read them. The channel is closed once we've left
+// the room, or after the returned function is called to unsubscribe.
+func (r *Room) Subscribe() (<-chan RoomEvent, func()) {
+	s := newSubscriber[RoomEvent](r.m.cl.deliveries)
+	subscribed := false
+	r.query(func(st *roomState) {
+		var evs []RoomEvent
+		for _, occ := range st.occupants {
+			evs = append(evs, RoomEvent{Type: OccupantJoined,
+				Occupant: occ, Self: occ.Nick == st.nick})
+		}
+		if len(evs) == 0 || s.send(evs) {
+			st.subs = append(st.subs, s)
+		}
+		subscribed = true
+	})
+	if !subscribed {
+		s.close()
+	}
+	return s.out, s.cancel
+}
+
+// Send sends a message to everyone in the room.
+func (r *Room) Send(body string) error {
+	return r.SendMessage(&Message{Body: []Text{{Chardata: body}}})
+}
+
+// SendMessage sends a message to everyone in the room. Its to and
+// type attributes are filled in, and an id if it has none.
+func (r *Room) SendMessage(msg *Message) error {
+	msg.To = r.Jid
+	msg.Type = "groupchat"
+	if msg.Id == "" {
+		msg.Id = r.m.cl.NextId()
+	}
+	return r.m.cl.SendStanza(msg)
+}
+
+// Leave leaves the room, with an optional status message, and waits
+// for the room to confirm it. XEP-0045, Section 7.14.
+func (r *Room) Leave(status string) error {
+	cl := r.m.cl
+	var nick string
+	var left chan struct{}
+	r.query(func(st *roomState) {
+		nick = st.nick
+		if st.leaving == nil {
+			st.leaving = make(chan struct{})
+		}
+		left = st.leaving
+	})
+	if left == nil {
+		return nil
+	}
+	pr := &Presence{Header: Header{To: r.Jid + "/" + JID(nick),
+		Id: cl.NextId(), Type: "unavailable"}}
+	if status != "" {
+		pr.Status = []Text{{Chardata: status}}
+	}
+	if err := cl.SendStanza(pr); err != nil {
+		return err
+	}
+	t := time.NewTimer(cl.replyTimeout())
+	defer t.Stop()
+	select {
+	case <-left:
+		return nil
+	case <-t.C:
+		// Forget the room anyway.
+		r.m.query(func(rooms map[JID]*roomState) {
+			if st := rooms[r.Jid]; st != nil && st.leaving == left {
+				st.end(nil)
+				delete(rooms, r.Jid)
+			}
+		})
+		return ErrNoReply
+	}
+}
@@ -0,0 +1,147 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Act as a room at room@muc.b.c, with one other occupant, "other".
+// The nickname "taken" is refused.
+func mucHandler(fs *fakeServer, e *rawElem) bool {
+	to := JID(e.attr("to"))
+	if e.XMLName.Local != "presence" || to.Domain() != "muc.b.c" {
+		return false
+	}
+	nick := to.Resource()
+	switch {
+	case e.attr("type") == "unavailable":
+		fs.write(fmt.Sprintf(`<presence from="%s" type="unavailable">`+
+			`<x xmlns="%s"><item role="none"/><status code="110"/>`+
+			`</x></presence>`, to, NsMUCUser))
+	case nick == "taken":
+		fs.write(fmt.Sprintf(`<presence from="%s" type="error">`+
+			`<error type="cancel"><conflict xmlns="%s"/></error>`+
+			`</presence>`, to, NsStanzas))
+	default:
+		fs.write(fmt.Sprintf(`<presence from="%s/other"><x xmlns="%s">`+
+			`<item affiliation="member" role="participant"/></x>`+
+			`</presence><presence from="%s"><x xmlns="%s">`+
+			`<item affiliation="owner" role="moderator"/>`+
+			`<status code="110"/><status code="201"/></x></presence>`,
+			to.Bare(), NsMUCUser, to, NsMUCUser))
+	}
+	fs.recv <- e
+	return true
+}
+
+func nextRoomEvent(t *testing.T, evs <-chan RoomEvent) RoomEvent {
+	select {
+	case ev, ok := <-evs:
+		if !ok {
+			t.Fatal("events closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no room event")
+	}
+	return RoomEvent{}
+}
+
+func TestMUCJoin(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.handle = mucHandler
+	cl := fs.client()
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	_, err := cl.MUC.Join("room@muc.b.c", "taken", nil)
+	var me *MUCError
+	if !errors.Is(err, ErrNickConflict) || !errors.As(err, &me) ||
+		me.Room != "room@muc.b.c" {
+		t.Errorf("taken: %v", err)
+	}
+	fs.next()
+
+	max := 5
+	room, err := cl.MUC.Join("room@muc.b.c/me", "", &JoinOptions{
+		Password: "pw", History: &History{MaxStanzas: &max}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := fs.next()
+	if !strings.Contains(e.Inner, `<password>pw</password>`) ||
+		!strings.Contains(e.Inner, `maxstanzas="5"`) {
+		t.Errorf("join %s", e.Inner)
+	}
+	if _, err := cl.MUC.Join("room@muc.b.c", "me", nil); err != ErrAlreadyJoined {
+		t.Errorf("second join: %v", err)
+	}
+	if !room.Created() || room.Nick() != "me" {
+		t.Errorf("created %v nick %q", room.Created(), room.Nick())
+	}
+	if occ, ok := room.Occupant("other"); !ok || occ.Role != "participant" {
+		t.Errorf("other %+v", occ)
+	}
+	if rs := cl.MUC.Rooms(); len(rs) != 1 || rs[0].Jid != room.Jid {
+		t.Errorf("rooms %v", rs)
+	}
+
+	evs, _ := room.Subscribe()
+	for i := 0; i < 2; i++ {
+		if ev := nextRoomEvent(t, evs); ev.Type != OccupantJoined {
+			t.Errorf("initial %v", ev.Type)
+		}
+	}
+
+	// We change nickname, and other is kicked.
+	fs.write(fmt.Sprintf(`<presence from="room@muc.b.c/me" `+
+		`type="unavailable"><x xmlns="%s"><item nick="you" `+
+		`role="moderator"/><status code="303"/><status code="110"/>`+
+		`</x></presence><presence from="room@muc.b.c/other" `+
+		`type="unavailable"><x xmlns="%s"><item role="none">`+
+		`<reason>spam</reason></item><status code="307"/></x>`+
+		`</presence>`, NsMUCUser, NsMUCUser))
+	ev := nextRoomEvent(t, evs)
+	if ev.Type != OccupantNickChanged || !ev.Self ||
+		ev.Old.Nick != "me" || ev.Occupant.Nick != "you" {
+		t.Errorf("nick change %+v", ev)
+	}
+	ev = nextRoomEvent(t, evs)
+	if ev.Type != OccupantKicked || ev.Self || ev.Reason != "spam" {
+		t.Errorf("kick %+v", ev)
+	}
+	if room.Nick() != "you" || len(room.Occupants()) != 1 {
+		t.Errorf("nick %q occupants %v", room.Nick(),
+			room.Occupants())
+	}
+
+	if err := room.Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	e = fs.next()
+	if e.attr("type") != "groupchat" || e.attr("to") != "room@muc.b.c" ||
+		!strings.Contains(e.Inner, "hello") {
+		t.Errorf("message %v %s", e.Attrs, e.Inner)
+	}
+
+	if err := room.Leave("bye"); err != nil {
+		t.Fatal(err)
+	}
+	if e := fs.next(); e.attr("to") != "room@muc.b.c/you" {
+		t.Errorf("leave %v", e.Attrs)
+	}
+	if ev := nextRoomEvent(t, evs); ev.Type != OccupantLeft || !ev.Self {
+		t.Errorf("leave %+v", ev)
+	}
+	if _, ok := <-evs; ok {
+		t.Error("events not closed")
+	}
+	if room.Joined() || len(cl.MUC.Rooms()) != 0 {
+		t.Error("still in room")
+	}
+}
@@ -0,0 +1,315 @@
+package xmpp
+
+// This file contains multi-user chat moderation, administration and
+// room configuration, XEP-0045, Sections 8 to 10.
+
+import (
+	"encoding/xml"
+	"errors"
+	"strconv"
+)
+
+// Returned by Room.Configure for a RoomConfig which didn't come from
+// Room.Config.
+var ErrNoConfigForm = errors.New("xmpp: room configuration wasn't fetched")
+
+// Roles an occupant may have in a room. XEP-0045, Section 5.1.
+const (
+	RoleModerator   = "moderator"
+	RoleParticipant = "participant"
+	RoleVisitor     = "visitor"
+	RoleNone        = "none"
+)
+
+// Affiliations a user may have with a room. XEP-0045, Section 5.2.
+const (
+	AffiliationOwner   = "owner"
+	AffiliationAdmin   = "admin"
+	AffiliationMember  = "member"
+	AffiliationOutcast = "outcast"
+	AffiliationNone    = "none"
+)
+
+// The FORM_TYPE of room configuration forms.
+const NsMUCRoomConfig = "http://jabber.org/protocol/muc#roomconfig"
+
+// Moderator and admin requests. XEP-0045, Section 8 and 9.
+type MUCAdminQuery struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/muc#admin query"`
+	Item    []MUCItem `xml:"item"`
+}
+
+// Owner requests. XEP-0045, Section 10.
+type MUCOwnerQuery struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/muc#owner query"`
+	Form    *DataForm `xml:"jabber:x:data x"`
+}
+
+// A room's configuration, from the fields of its muc#roomconfig form.
+// XEP-0045, Section 10.2.
+type RoomConfig struct {
+	Name              string
+	Description       string
+	Persistent        bool
+	Public            bool
+	MembersOnly       bool
+	Moderated         bool
+	PasswordProtected bool
+	Password          string
+	// The most occupants allowed, or 0 for no limit.
+	MaxUsers int
+	// Who may see occupants' real JIDs: "moderators" or "anyone".
+	Whois         string
+	ChangeSubject bool
+	AllowInvites  bool
+	EnableLogging bool
+	Owners        []JID
+	Admins        []JID
+	// The values of the form's other fields, by var. They're
+	// submitted as they are.
+	Other map[string][]string
+	// The form the room sent. Only configurations from Room.Config
+	// have one, and only they can be submitted.
+	form *DataForm
+}
+
+// How a field of the room configuration form maps to RoomConfig.
+type roomConfigField struct {
+	get func(c *RoomConfig) []string
+	set func(c *RoomConfig, values []string)
+}
+
+func boolConfig(p func(c *RoomConfig) *bool) roomConfigField {
+	return roomConfigField{
+		get: func(c *RoomConfig) []string {
+			if *p(c) {
+				return []string{"1"}
+			}
+			return []string{"0"}
+		},
+		set: func(c *RoomConfig, values []string) {
+			*p(c) = len(values) > 0 &&
+				(values[0] == "1" || values[0] == "true")
+		},
+	}
+}
+
+func stringConfig(p func(c *RoomConfig) *string) roomConfigField {
+	return roomConfigField{
+		get: func(c *RoomConfig) []string { return []string{*p(c)} },
+		set: func(c *RoomConfig, values []string) {
+			*p(c) = ""
+			if len(values) > 0 {
+				*p(c) = values[0]
+			}
+		},
+	}
+}
+
+func jidsConfig(p func(c *RoomConfig) *[]JID) roomConfigField {
+	return roomConfigField{
+		get: func(c *RoomConfig) []string {
+			var values []string
+			for _, jid := range *p(c) {
+				values = append(values, string(jid))
+			}
+			return values
+		},
+		set: func(c *RoomConfig, values []string) {
+			*p(c) = nil
+			for _, v := range values {
+				*p(c) = append(*p(c), JID(v))
+			}
+		},
+	}
+}
+
+var roomConfigFields = map[string]roomConfigField{
+	"muc#roomconfig_roomname": stringConfig(
+		func(c *RoomConfig) *string { return &c.Name }),
+	"muc#roomconfig_roomdesc": stringConfig(
+		func(c *RoomConfig) *string { return &c.Description }),
+	"muc#roomconfig_persistentroom": boolConfig(
+		func(c *RoomConfig) *bool { return &c.Persistent }),
+	"muc#roomconfig_publicroom": boolConfig(
+		func(c *RoomConfig) *bool { return &c.Public }),
+	"muc#roomconfig_membersonly": boolConfig(
+		func(c *RoomConfig) *bool { return &c.MembersOnly }),
+	"muc#roomconfig_moderatedroom": boolConfig(
+		func(c *RoomConfig) *bool { return &c.Moderated }),
+	"muc#roomconfig_passwordprotectedroom": boolConfig(
+		func(c *RoomConfig) *bool { return &c.PasswordProtected }),
+	"muc#roomconfig_roomsecret": stringConfig(
+		func(c *RoomConfig) *string { return &c.Password }),
+	"muc#roomconfig_whois": stringConfig(
+		func(c *RoomConfig) *string { return &c.Whois }),
+	"muc#roomconfig_changesubject": boolConfig(
+		func(c *RoomConfig) *bool { return &c.ChangeSubject }),
+	"muc#roomconfig_allowinvites": boolConfig(
+		func(c *RoomConfig) *bool { return &c.AllowInvites }),
+	"muc#roomconfig_enablelogging": boolConfig(
+		func(c *RoomConfig) *bool { return &c.EnableLogging }),
+	"muc#roomconfig_roomowners": jidsConfig(
+		func(c *RoomConfig) *[]JID { return &c.Owners }),
+	"muc#roomconfig_roomadmins": jidsConfig(
+		func(c *RoomConfig) *[]JID { return &c.Admins }),
+	"muc#roomconfig_maxusers": {
+		get: func(c *RoomConfig) []string {
+			if c.MaxUsers <= 0 {
+				return []string{"none"}
+			}
+			return []string{strconv.Itoa(c.MaxUsers)}
+		},
+		set: func(c *RoomConfig, values []string) {
+			c.MaxUsers = 0
+			if len(values) > 0 {
+				c.MaxUsers, _ = strconv.Atoi(values[0])
+			}
+		},
+	},
+}
+
+// Read a configuration form sent by a room.
+func parseRoomConfig(form *DataForm) *RoomConfig {
+	c := &RoomConfig{Other: make(map[string][]string), form: form}
+	for _, field := range form.Field {
+		if field.Var == "" || field.Var == FormType {
+			continue
+		}
+		if f, ok := roomConfigFields[field.Var]; ok {
+			f.set(c, field.Value)
+		} else if field.Type != "fixed" {
+			c.Other[field.Var] = field.Value
+		}
+	}
+	return c
+}
+
+// Fill in a form to submit the configuration. Only the fields the
+// room offered are sent, so ones it doesn't know aren't set to zero
+// values.
+func (c *RoomConfig) submitForm() *DataForm {
+	form := &DataForm{Type: "submit"}
+	form.Set(FormType, NsMUCRoomConfig)
+	for _, field := range c.form.Field {
+		if field.Var == "" || field.Var == FormType ||
+			field.Type == "fixed" {
+			continue
+		}
+		if f, ok := roomConfigFields[field.Var]; ok {
+			form.Set(field.Var, f.get(c)...)
+		} else if values, ok := c.Other[field.Var]; ok {
+			form.Set(field.Var, values...)
+		}
+	}
+	return form
+}
+
+// Send a request to the room, and turn an error reply into a
+// *MUCError.
+func (r *Room) request(typ string, query interface{}) (*Iq, error) {
+	cl := r.m.cl
+	iq := &Iq{Header: Header{To: r.Jid, Id: cl.NextId(), Type: typ,
+		Nested: []interface{}{query}}}
+	res, err := cl.request(iq)
+	if err != nil {
+		return nil, err
+	}
+	if res.Type == "error" {
+		me := &MUCError{Room: r.Jid, Err: res.Error}
+		if res.Error != nil {
+			me.Condition = res.Error.Condition()
+		}
+		return nil, me
+	}
+	return res, nil
+}
+
+// SetRole changes the role of the occupant with the given nickname,
+// giving an optional reason. Setting RoleNone kicks them,
+// RoleParticipant grants them voice, RoleVisitor revokes it, and
+// RoleModerator makes them a moderator. XEP-0045, Section 8.
+func (r *Room) SetRole(nick, role, reason string) error {
+	_, err := r.request("set", &MUCAdminQuery{Item: []MUCItem{
+		{Nick: nick, Role: role, Reason: reason}}})
+	return err
+}
+
+// Kick removes the occupant with the given nickname from the room.
+// XEP-0045, Section 8.2.
+func (r *Room) Kick(nick, reason string) error {
+	return r.SetRole(nick, RoleNone, reason)
+}
+
+// SetAffiliation changes a user's affiliation with the room, giving
+// an optional reason. jid is the user's bare JID. Setting
+// AffiliationOutcast bans them; AffiliationMember, AffiliationAdmin
+// and AffiliationOwner grant membership, admin and owner status, and
+// AffiliationNone takes it away. XEP-0045, Sections 9 and 10.
+func (r *Room) SetAffiliation(jid JID, affiliation, reason string) error {
+	_, err := r.request("set", &MUCAdminQuery{Item: []MUCItem{
+		{Jid: jid, Affiliation: affiliation, Reason: reason}}})
+	return err
+}
+
+// Ban bans a user from the room. XEP-0045, Section 9.1.
+func (r *Room) Ban(jid JID, reason string) error {
+	return r.SetAffiliation(jid, AffiliationOutcast, reason)
+}
+
+// Affiliations returns the users with the given affiliation, such as
+// AffiliationOutcast for the ban list. XEP-0045, Sections 9 and 10.
+func (r *Room) Affiliations(affiliation string) ([]MUCItem, error) {
+	res, err := r.request("get", &MUCAdminQuery{Item: []MUCItem{
+		{Affiliation: affiliation}}})
+	if err != nil {
+		return nil, err
+	}
+	if q := FindNested[MUCAdminQuery](res); q != nil {
+		return q.Item, nil
+	}
+	return nil, nil
+}
+
+// CreateInstant accepts the default configuration of a room we've
+// just created, so others can join it. XEP-0045, Section 10.1.2.
+func (r *Room) CreateInstant() error {
+	_, err := r.request("set", &MUCOwnerQuery{
+		Form: &DataForm{Type: "submit"}})
+	return err
+}
+
+// Config fetches the room's configuration. To create a reserved room,
+// call it after joining, change what's needed, and pass the result to
+// Configure. XEP-0045, Sections 10.1.3 and 10.2.
+func (r *Room) Config() (*RoomConfig, error) {
+	res, err := r.request("get", &MUCOwnerQuery{})
+	if err != nil {
+		return nil, err
+	}
+	q := FindNested[MUCOwnerQuery](res)
+	if q == nil || q.Form == nil {
+		return nil, &MUCError{Room: r.Jid,
+			Condition: "service-unavailable"}
+	}
+	return parseRoomConfig(q.Form), nil
+}
+
+// Configure submits the room's configuration. c must have come from
+// Config; otherwise it returns ErrNoConfigForm, since fields the
+// caller didn't fill in would be submitted as zero values.
+func (r *Room) Configure(c *RoomConfig) error {
+	if c.form == nil {
+		return ErrNoConfigForm
+	}
+	_, err := r.request("set", &MUCOwnerQuery{Form: c.submitForm()})
+	return err
+}
+
+// CancelConfig abandons configuring a room we've just created, which
+// the room then destroys. XEP-0045, Section 10.1.3.
+func (r *Room) CancelConfig() error {
+	_, err := r.request("set", &MUCOwnerQuery{
+		Form: &DataForm{Type: "cancel"}})
+	return err
+}
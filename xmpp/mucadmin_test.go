@@ -0,0 +1,131 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testRoomConfig = `<x xmlns="jabber:x:data" type="form">` +
+	`<field var="FORM_TYPE" type="hidden"><value>` + NsMUCRoomConfig +
+	`</value></field>` +
+	`<field var="muc#roomconfig_roomname"><value>Old</value></field>` +
+	`<field var="muc#roomconfig_membersonly" type="boolean">` +
+	`<value>0</value></field>` +
+	`<field var="muc#roomconfig_maxusers"><value>20</value></field>` +
+	`<field var="muc#roomconfig_roomadmins" type="jid-multi">` +
+	`<value>a@b.c</value><value>d@b.c</value></field>` +
+	`<field var="x-custom"><value>v</value></field>` +
+	`<field type="fixed"><value>Notes</value></field></x>`
+
+// Act as the admin and owner of room@muc.b.c. Setting a role on
+// "nobody" fails.
+func mucAdminHandler(fs *fakeServer, e *rawElem) bool {
+	if e.XMLName.Local != "iq" || e.attr("to") != "room@muc.b.c" {
+		return mucHandler(fs, e)
+	}
+	id, typ := e.attr("id"), e.attr("type")
+	switch {
+	case strings.Contains(e.Inner, `nick="nobody"`):
+		fs.write(fmt.Sprintf(`<iq type="error" id="%s" `+
+			`from="room@muc.b.c"><error type="cancel">`+
+			`<item-not-found xmlns="%s"/></error></iq>`, id,
+			NsStanzas))
+	case typ == "get" && strings.Contains(e.Inner, "muc#admin"):
+		fs.write(fmt.Sprintf(`<iq type="result" id="%s" `+
+			`from="room@muc.b.c"><query xmlns="%s#admin">`+
+			`<item affiliation="outcast" jid="x@b.c"/></query></iq>`,
+			id, NsMUC))
+	case typ == "get" && strings.Contains(e.Inner, "muc#owner"):
+		fs.write(fmt.Sprintf(`<iq type="result" id="%s" `+
+			`from="room@muc.b.c"><query xmlns="%s#owner">%s`+
+			`</query></iq>`, id, NsMUC, testRoomConfig))
+	default:
+		fs.write(fmt.Sprintf(`<iq type="result" id="%s" `+
+			`from="room@muc.b.c"/>`, id))
+	}
+	fs.recv <- e
+	return true
+}
+
+func TestMUCAdmin(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.handle = mucAdminHandler
+	cl := fs.client()
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+	room, err := cl.MUC.Join("room@muc.b.c", "me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.next()
+
+	if err := room.Kick("other", "spam"); err != nil {
+		t.Fatal(err)
+	}
+	e := fs.next()
+	if !strings.Contains(e.Inner, `nick="other"`) ||
+		!strings.Contains(e.Inner, `role="none"`) ||
+		!strings.Contains(e.Inner, `<reason>spam</reason>`) {
+		t.Errorf("kick %s", e.Inner)
+	}
+	err = room.SetRole("nobody", RoleParticipant, "")
+	var me *MUCError
+	if !errors.As(err, &me) || me.Condition != "item-not-found" {
+		t.Errorf("missing: %v", err)
+	}
+	fs.next()
+	if err := room.Ban("x@b.c", ""); err != nil {
+		t.Fatal(err)
+	}
+	if e := fs.next(); !strings.Contains(e.Inner, `affiliation="outcast"`) {
+		t.Errorf("ban %s", e.Inner)
+	}
+	items, err := room.Affiliations(AffiliationOutcast)
+	if err != nil || len(items) != 1 || items[0].Jid != "x@b.c" {
+		t.Errorf("outcasts %v %v", items, err)
+	}
+	fs.next()
+
+	c, err := room.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.next()
+	if c.Name != "Old" || c.MembersOnly || c.MaxUsers != 20 ||
+		len(c.Admins) != 2 || c.Other["x-custom"][0] != "v" {
+		t.Errorf("config %+v", c)
+	}
+	c.Name = "New"
+	c.MembersOnly = true
+	if err := room.Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	e = fs.next()
+	var q MUCOwnerQuery
+	if err := xml.Unmarshal([]byte(e.Inner), &q); err != nil || q.Form == nil {
+		t.Fatalf("configure %s: %v", e.Inner, err)
+	}
+	f := q.Form
+	if f.Type != "submit" || f.Value(FormType) != NsMUCRoomConfig ||
+		f.Value("muc#roomconfig_roomname") != "New" ||
+		f.Value("muc#roomconfig_membersonly") != "1" ||
+		f.Value("x-custom") != "v" || len(f.Field) != 6 {
+		t.Errorf("submitted %+v", f)
+	}
+	err = room.Configure(&RoomConfig{Name: "Blank"})
+	if err != ErrNoConfigForm {
+		t.Errorf("unfetched config: %v", err)
+	}
+
+	if err := room.CreateInstant(); err != nil {
+		t.Fatal(err)
+	}
+	if e := fs.next(); !strings.Contains(e.Inner, `type="submit"`) {
+		t.Errorf("instant %s", e.Inner)
+	}
+}
@@ -0,0 +1,242 @@
+package xmpp
+
+// This file contains support for invitations to multi-user chat
+// rooms: mediated ones, XEP-0045, Section 7.8, and direct ones,
+// XEP-0249.
+
+import (
+	"encoding/xml"
+	"log/slog"
+)
+
+// A mediated invitation, or the refusal of one. When we send it to
+// the room, To is the invitee or inviter; when the room passes it on,
+// From is.
+type MUCInvite struct {
+	From   JID    `xml:"from,attr,omitempty"`
+	To     JID    `xml:"to,attr,omitempty"`
+	Reason string `xml:"reason,omitempty"`
+}
+
+// A direct invitation. XEP-0249.
+type DirectInvite struct {
+	XMLName  xml.Name `xml:"jabber:x:conference x"`
+	Jid      JID      `xml:"jid,attr"`
+	Password string   `xml:"password,attr,omitempty"`
+	Reason   string   `xml:"reason,attr,omitempty"`
+}
+
+// An invitation to a room, of either kind.
+type Invitation struct {
+	// The room's bare JID.
+	Room JID
+	// Who invited us. For a direct invitation, this is Sender. For
+	// a mediated one, it's whoever the sender says it is, which
+	// can only be believed if the sender is a room we trust.
+	From     JID
+	Reason   string
+	Password string
+	// Whether the invitation came directly from the inviter,
+	// rather than by way of the room.
+	Direct bool
+	// Who sent the message which carried the invitation, as
+	// stamped by our server: the inviter for a direct invitation,
+	// and supposedly the room for a mediated one.
+	Sender JID
+	// The message which carried the invitation.
+	Message *Message
+}
+
+// The refusal of an invitation we sent through a room.
+type DeclinedInvitation struct {
+	// The room's bare JID.
+	Room JID
+	// Who refused.
+	From   JID
+	Reason string
+}
+
+// ParseInvitation returns the invitation carried by a message, or nil
+// if it doesn't carry one.
+func ParseInvitation(msg *Message) *Invitation {
+	if x := FindNested[MUCUser](msg); x != nil && len(x.Invite) > 0 {
+		return &Invitation{Room: msg.From.Bare(),
+			From: x.Invite[0].From, Reason: x.Invite[0].Reason,
+			Password: x.Password, Sender: msg.From, Message: msg}
+	}
+	if x := FindNested[DirectInvite](msg); x != nil && x.Jid != "" {
+		return &Invitation{Room: x.Jid.Bare(), From: msg.From,
+			Reason: x.Reason, Password: x.Password, Direct: true,
+			Sender: msg.From, Message: msg}
+	}
+	return nil
+}
+
+// ParseDecline returns the refusal of an invitation carried by a
+// message, or nil if it doesn't carry one.
+func ParseDecline(msg *Message) *DeclinedInvitation {
+	x := FindNested[MUCUser](msg)
+	if x == nil || x.Decline == nil {
+		return nil
+	}
+	return &DeclinedInvitation{Room: msg.From.Bare(),
+		From: x.Decline.From, Reason: x.Decline.Reason}
+}
+
+// What to do with an invitation.
+type InvitationDecision int
+
+const (
+	// Leave the invitation unanswered, for the application to
+	// answer later with MUC.Accept or MUC.Decline.
+	InvitationPending InvitationDecision = iota
+	// Join the room.
+	InvitationAccept
+	// Decline the invitation.
+	InvitationDecline
+)
+
+// An InvitationPolicy decides what to do with invitations to rooms.
+// It's called on its own goroutine, so it may block, for instance to
+// ask a person.
+//
+// Only an invitation's Sender is vouched for, by our server. Anyone
+// can send a mediated invitation claiming to be from anyone, naming
+// their own JID as the room, so a policy which accepts invitations
+// mustn't believe From, Room or Password unless Sender is a room on a
+// service it trusts. TrustInviters takes care of this.
+type InvitationPolicy func(inv *Invitation) InvitationDecision
+
+// WithInvitationPolicy has the client hand each invitation it
+// receives to policy, and act on its decision. Rooms are joined under
+// nick, or the node of our JID if nick is empty. Invitations then no
+// longer appear on Client.Recv. Without a policy, they're delivered
+// there like any other message; see ParseInvitation.
+func WithInvitationPolicy(policy InvitationPolicy, nick string) Option {
+	return func(cl *Client) {
+		cl.invitePolicy = policy
+		cl.inviteNick = nick
+	}
+}
+
+// TrustInviters returns an InvitationPolicy which accepts invitations
+// from the given bare JIDs, and hands the rest to otherwise. If
+// otherwise is nil, the rest are left pending. A direct invitation is
+// trusted if it was sent by one of the JIDs. A mediated one is only
+// trusted if it was sent by a room on one of the given MUC services,
+// such as "conference.example.com", and the room says it's from one
+// of the JIDs.
+func TrustInviters(otherwise InvitationPolicy, services []string,
+	jids ...JID) InvitationPolicy {
+
+	trusted := func(inv *Invitation) bool {
+		from := inv.Sender
+		if !inv.Direct {
+			if from.Node() == "" || from.Resource() != "" ||
+				!containsString(services, from.Domain()) {
+				return false
+			}
+			from = inv.From
+		}
+		for _, jid := range jids {
+			if from.Bare() == jid.Bare() {
+				return true
+			}
+		}
+		return false
+	}
+	return func(inv *Invitation) InvitationDecision {
+		if trusted(inv) {
+			return InvitationAccept
+		}
+		if otherwise == nil {
+			return InvitationPending
+		}
+		return otherwise(inv)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MUC) interceptInvite(st Stanza) (Stanza, bool) {
+	cl := m.cl
+	msg, ok := st.(*Message)
+	if !ok || cl.invitePolicy == nil || msg.Type == "error" {
+		return st, true
+	}
+	inv := ParseInvitation(msg)
+	if inv == nil {
+		return st, true
+	}
+	// Not tracked by spawn: the policy may wait on a person, and
+	// mustn't hold up shutting down.
+	go m.decideInvitation(inv)
+	return nil, false
+}
+
+func (m *MUC) decideInvitation(inv *Invitation) {
+	cl := m.cl
+	var err error
+	switch cl.invitePolicy(inv) {
+	case InvitationAccept:
+		nick := cl.inviteNick
+		if nick == "" {
+			nick = cl.Jid.Node()
+		}
+		_, err = m.Accept(inv, nick)
+	case InvitationDecline:
+		err = m.Decline(inv, "")
+	}
+	if err != nil {
+		cl.logAttrs(slog.LevelWarn, "can't answer invitation",
+			slog.String("room", string(inv.Room)),
+			slog.String("from", string(inv.From)),
+			slog.Any("err", err))
+	}
+}
+
+// Accept joins the room we've been invited to, under the given
+// nickname.
+func (m *MUC) Accept(inv *Invitation, nick string) (*Room, error) {
+	return m.Join(inv.Room, nick, &JoinOptions{Password: inv.Password})
+}
+
+// Decline refuses an invitation, giving an optional reason. There's
+// no way to refuse a direct invitation, so it's just ignored.
+func (m *MUC) Decline(inv *Invitation, reason string) error {
+	if inv.Direct {
+		return nil
+	}
+	cl := m.cl
+	msg := &Message{Header: Header{To: inv.Room, Id: cl.NextId(),
+		Nested: []interface{}{&MUCUser{Decline: &MUCInvite{
+			To: inv.From, Reason: reason}}}}}
+	return cl.SendStanza(msg)
+}
+
+// InviteDirect invites someone to a room by sending them the
+// invitation directly, rather than through the room. XEP-0249.
+func (m *MUC) InviteDirect(to, room JID, password, reason string) error {
+	cl := m.cl
+	msg := &Message{Header: Header{To: to, Id: cl.NextId(),
+		Nested: []interface{}{&DirectInvite{Jid: room.Bare(),
+			Password: password, Reason: reason}}}}
+	return cl.SendStanza(msg)
+}
+
+// Invite invites someone to the room, by way of the room. XEP-0045,
+// Section 7.8.2.
+func (r *Room) Invite(jid JID, reason string) error {
+	cl := r.m.cl
+	msg := &Message{Header: Header{To: r.Jid, Id: cl.NextId(),
+		Nested: []interface{}{&MUCUser{Invite: []MUCInvite{
+			{To: jid, Reason: reason}}}}}}
+	return cl.SendStanza(msg)
+}
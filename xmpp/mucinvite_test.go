@@ -0,0 +1,116 @@
+package xmpp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseInvitation(t *testing.T) {
+	msg := &Message{Header: Header{From: "room@muc.b.c",
+		Nested: []interface{}{&MUCUser{Decline: &MUCInvite{
+			From: "x@b.c", Reason: "busy"}}}}}
+	if ParseInvitation(msg) != nil {
+		t.Error("decline parsed as invitation")
+	}
+	d := ParseDecline(msg)
+	if d == nil || d.Room != "room@muc.b.c" || d.From != "x@b.c" ||
+		d.Reason != "busy" {
+		t.Errorf("decline %+v", d)
+	}
+	msg = &Message{Header: Header{From: "boss@b.c/r",
+		Nested: []interface{}{&DirectInvite{Jid: "room@muc.b.c",
+			Password: "pw"}}}}
+	inv := ParseInvitation(msg)
+	if inv == nil || !inv.Direct || inv.Room != "room@muc.b.c" ||
+		inv.From != "boss@b.c/r" || inv.Password != "pw" {
+		t.Errorf("direct %+v", inv)
+	}
+}
+
+func TestInvitationPolicy(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.handle = mucHandler
+	untrusted := make(chan *Invitation, 1)
+	cl := fs.client(WithInvitationPolicy(TrustInviters(
+		func(inv *Invitation) InvitationDecision {
+			if inv.From == "boss@b.c/r" {
+				// Someone pretending to be boss.
+				untrusted <- inv
+				return InvitationPending
+			}
+			return InvitationDecline
+		}, []string{"muc.b.c"}, "boss@b.c"), "bot"))
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	spoofs := []string{
+		// From a user, not a room.
+		`<message from="attacker@evil.example/r">`,
+		// From a room on a service we don't trust.
+		`<message from="room@evil.example">`,
+		// From an occupant, not the room itself.
+		`<message from="room@muc.b.c/boss">`,
+	}
+	for _, spoof := range spoofs {
+		fs.write(fmt.Sprintf(`%s<x xmlns="%s"><invite `+
+			`from="boss@b.c/r"/></x></message>`, spoof, NsMUCUser))
+		select {
+		case inv := <-untrusted:
+			if inv.Direct || inv.Sender == "" {
+				t.Errorf("spoof %+v", inv)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("trusted %s", spoof)
+		}
+	}
+
+	fs.write(fmt.Sprintf(`<message from="room@muc.b.c" to="user@example.com">`+
+		`<x xmlns="%s"><invite from="boss@b.c/r"><reason>hi</reason>`+
+		`</invite><password>pw</password></x></message>`, NsMUCUser))
+	e := fs.next()
+	if e.attr("to") != "room@muc.b.c/bot" ||
+		!strings.Contains(e.Inner, "<password>pw</password>") {
+		t.Errorf("join %v %s", e.Attrs, e.Inner)
+	}
+
+	fs.write(fmt.Sprintf(`<message from="other@muc.b.c">`+
+		`<x xmlns="%s"><invite from="spam@b.c"/></x></message>`,
+		NsMUCUser))
+	e = fs.next()
+	if e.XMLName.Local != "message" || e.attr("to") != "other@muc.b.c" ||
+		!strings.Contains(e.Inner, `<decline to="spam@b.c">`) {
+		t.Errorf("decline %v %s", e.Attrs, e.Inner)
+	}
+
+	fs.write(fmt.Sprintf(`<message from="boss@b.c/r">`+
+		`<x xmlns="%s" jid="third@muc.b.c"/></message>`, NsConference))
+	if e := fs.next(); e.attr("to") != "third@muc.b.c/bot" {
+		t.Errorf("direct join %v", e.Attrs)
+	}
+
+	room, ok := cl.MUC.Room("room@muc.b.c")
+	if !ok {
+		t.Fatal("not in room")
+	}
+	if err := room.Invite("friend@b.c", "come"); err != nil {
+		t.Fatal(err)
+	}
+	e = fs.next()
+	if e.attr("to") != "room@muc.b.c" ||
+		!strings.Contains(e.Inner, `<invite to="friend@b.c">`) {
+		t.Errorf("invite %v %s", e.Attrs, e.Inner)
+	}
+	err := cl.MUC.InviteDirect("friend@b.c", "room@muc.b.c", "", "come")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = fs.next()
+	if e.attr("to") != "friend@b.c" ||
+		!strings.Contains(e.Inner, `jid="room@muc.b.c"`) {
+		t.Errorf("direct invite %v %s", e.Attrs, e.Inner)
+	}
+}
@@ -0,0 +1,194 @@
+package xmpp
+
+// This file contains checks that we're still in our multi-user chat
+// rooms, XEP-0410, and rejoining them when we're not.
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// WithMUCSelfPing has the client ping its own occupant JID in each
+// room every interval. If the room says we're no longer there, we
+// rejoin under the same nickname and password, asking for the history
+// we missed. Subscribers to the room see RoomDisconnected, then
+// RoomRejoined or RoomRejoinFailed. A ping which isn't answered within
+// timeout tells us nothing, and is tried again at the next interval.
+// If timeout isn't positive, the callback timeout is used; see
+// WithCallbackTimeout.
+func WithMUCSelfPing(interval, timeout time.Duration) Option {
+	return func(cl *Client) {
+		cl.mucPingInterval = interval
+		cl.mucPingTimeout = timeout
+	}
+}
+
+// A room to check, and our nickname there.
+type selfPingTarget struct {
+	room   JID
+	nick   string
+	joined bool
+}
+
+// Interpret the answer to a self-ping: whether we're in the room, and
+// whether the answer tells us anything. XEP-0410, Section 3.
+func selfPingJoined(err error) (joined, known bool) {
+	if err == nil {
+		return true, true
+	}
+	var xe *Error
+	if !errors.As(err, &xe) {
+		return false, false
+	}
+	switch xe.Condition() {
+	case "service-unavailable", "feature-not-implemented":
+		// We're there, but our own client doesn't answer
+		// pings.
+		return true, true
+	case "item-not-found":
+		// We're there, but a change of nickname is under
+		// way.
+		return true, true
+	case "remote-server-not-found", "remote-server-timeout":
+		return false, false
+	}
+	// Anything else, such as not-acceptable, means we're not.
+	return false, true
+}
+
+func (m *MUC) selfPingLoop(status <-chan Status) {
+	tick := time.NewTicker(m.cl.mucPingInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case stat, ok := <-status:
+			if !ok || stat.Fatal() {
+				return
+			}
+			continue
+		case <-tick.C:
+		}
+		var wg sync.WaitGroup
+		for _, t := range m.selfPingTargets() {
+			wg.Add(1)
+			go func(t selfPingTarget) {
+				defer wg.Done()
+				m.selfPing(t)
+			}(t)
+		}
+		wg.Wait()
+	}
+}
+
+// The rooms we're in, or have dropped out of and not yet got back
+// into.
+func (m *MUC) selfPingTargets() []selfPingTarget {
+	var targets []selfPingTarget
+	m.query(func(rooms map[JID]*roomState) {
+		for jid, st := range rooms {
+			if st.joining != nil || st.leaving != nil {
+				continue
+			}
+			if st.joined || st.rejoining {
+				targets = append(targets, selfPingTarget{
+					room: jid, nick: st.nick,
+					joined: st.joined})
+			}
+		}
+	})
+	return targets
+}
+
+func (m *MUC) selfPing(t selfPingTarget) {
+	cl := m.cl
+	if !t.joined {
+		// An earlier attempt to rejoin got no answer.
+		m.rejoin(t.room)
+		return
+	}
+	timeout := cl.mucPingTimeout
+	if timeout <= 0 {
+		timeout = cl.replyTimeout()
+	}
+	var err error
+	timer := time.NewTimer(timeout)
+	select {
+	case err = <-cl.sendPing(t.room + "/" + JID(t.nick)):
+		timer.Stop()
+	case <-timer.C:
+		err = ErrPingTimeout
+	}
+	joined, known := selfPingJoined(err)
+	switch {
+	case !known:
+		cl.logAttrs(slog.LevelDebug, "no answer to room self-ping",
+			slog.String("room", string(t.room)),
+			slog.Any("err", err))
+	case joined:
+		m.query(func(rooms map[JID]*roomState) {
+			if st := rooms[t.room]; st != nil && st.joined {
+				st.lastSeen = time.Now()
+			}
+		})
+	default:
+		cl.logAttrs(slog.LevelInfo, "dropped out of room",
+			slog.String("room", string(t.room)),
+			slog.Any("err", err))
+		m.rejoin(t.room)
+	}
+}
+
+// Join a room again, after we've dropped out of it.
+func (m *MUC) rejoin(room JID) {
+	cl := m.cl
+	result := make(chan error, 1)
+	var nick string
+	var opts JoinOptions
+	ok := false
+	m.query(func(rooms map[JID]*roomState) {
+		st := rooms[room]
+		if st == nil || st.joining != nil || st.leaving != nil {
+			return
+		}
+		if st.joined {
+			st.joined = false
+			// We no longer know who's there.
+			st.occupants = make(map[string]Occupant)
+			st.subs = publish(st.subs, []RoomEvent{{
+				Type: RoomDisconnected, Self: true}})
+		}
+		st.rejoining = true
+		st.joining = result
+		nick, opts, ok = st.nick, st.opts, true
+		if !st.lastSeen.IsZero() {
+			since := st.lastSeen
+			opts.History = &History{Since: &since}
+		}
+	})
+	if !ok {
+		return
+	}
+	err := m.sendJoin(room, nick, &opts)
+	if err == nil {
+		t := time.NewTimer(cl.replyTimeout())
+		select {
+		case err = <-result:
+		case <-t.C:
+			err = ErrNoReply
+		}
+		t.Stop()
+	}
+	if err == nil {
+		return
+	}
+	cl.logAttrs(slog.LevelWarn, "can't rejoin room",
+		slog.String("room", string(room)), slog.Any("err", err))
+	// Unless the room refused us, try again at the next ping.
+	m.query(func(rooms map[JID]*roomState) {
+		if st := rooms[room]; st != nil && st.joining == result {
+			st.joining = nil
+		}
+	})
+}
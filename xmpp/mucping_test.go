@@ -0,0 +1,100 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelfPingJoined(t *testing.T) {
+	// A defined condition followed by an application-specific one.
+	appErr := &Error{}
+	err := xml.Unmarshal([]byte(`<error type="cancel">`+
+		`<service-unavailable xmlns="`+NsStanzas+`"/>`+
+		`<busy xmlns="urn:example:app"/></error>`), appErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		err           error
+		joined, known bool
+	}{
+		{nil, true, true},
+		{NewError("cancel", "service-unavailable"), true, true},
+		{NewError("cancel", "item-not-found"), true, true},
+		{appErr, true, true},
+		{NewError("modify", "not-acceptable"), false, true},
+		{NewError("cancel", "remote-server-timeout"), false, false},
+		{ErrPingTimeout, false, false},
+	}
+	for _, test := range tests {
+		joined, known := selfPingJoined(test.err)
+		if joined != test.joined || known != test.known {
+			t.Errorf("%v: joined %v known %v", test.err, joined,
+				known)
+		}
+	}
+}
+
+func TestMUCRejoin(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	var lock sync.Mutex
+	kicked := false
+	fs.handle = func(fs *fakeServer, e *rawElem) bool {
+		if e.XMLName.Local != "iq" ||
+			!strings.Contains(e.Inner, NsPing) {
+			return mucHandler(fs, e)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if kicked {
+			fs.write(fmt.Sprintf(`<iq type="error" id="%s" `+
+				`from="%s"><error type="modify">`+
+				`<not-acceptable xmlns="%s"/></error></iq>`,
+				e.attr("id"), e.attr("to"), NsStanzas))
+			kicked = false
+		} else {
+			fs.write(fmt.Sprintf(`<iq type="result" id="%s" `+
+				`from="%s"/>`, e.attr("id"), e.attr("to")))
+		}
+		return true
+	}
+	cl := fs.client(WithMUCSelfPing(20*time.Millisecond, time.Second))
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+	room, err := cl.MUC.Join("room@muc.b.c", "me",
+		&JoinOptions{Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.next()
+	evs, _ := room.Subscribe()
+	nextRoomEvent(t, evs)
+	nextRoomEvent(t, evs)
+
+	lock.Lock()
+	kicked = true
+	lock.Unlock()
+	e := fs.next()
+	if e.attr("to") != "room@muc.b.c/me" ||
+		!strings.Contains(e.Inner, "<password>pw</password>") ||
+		!strings.Contains(e.Inner, "since=") {
+		t.Errorf("rejoin %v %s", e.Attrs, e.Inner)
+	}
+	want := []RoomEventType{RoomDisconnected, OccupantJoined,
+		OccupantJoined, RoomRejoined}
+	for _, typ := range want {
+		if ev := nextRoomEvent(t, evs); ev.Type != typ {
+			t.Errorf("got %v, want %v", ev.Type, typ)
+		}
+	}
+	if !room.Joined() || len(room.Occupants()) != 2 {
+		t.Errorf("joined %v occupants %v", room.Joined(),
+			room.Occupants())
+	}
+}
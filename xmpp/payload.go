@@ -0,0 +1,91 @@
+package xmpp
+
+// Typed access to the extension payloads nested inside stanzas, in
+// both directions: parsing is driven by Extension.StanzaTypes, and
+// the same registry is used to check what the application sends.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+)
+
+// RegisterPayload adds T to the extension's StanzaTypes, under the
+// XML name given by T's XMLName field tag. Incoming nested elements
+// with that name will be parsed into a *T. It panics if T has no
+// namespace-qualified XMLName tag.
+func RegisterPayload[T any](ext *Extension) {
+	var zero T
+	name, ok := xmlName(&zero)
+	if !ok || name.Space == "" {
+		panic(fmt.Sprintf("xmpp: no XML name for payload %T", zero))
+	}
+	if ext.StanzaTypes == nil {
+		ext.StanzaTypes = make(map[xml.Name]reflect.Type)
+	}
+	ext.StanzaTypes[name] = reflect.TypeOf(zero)
+}
+
+// FindNested returns the first element nested in the stanza which is
+// of type T or *T, or nil if there is none.
+func FindNested[T any](st Stanza) *T {
+	for _, ele := range st.GetHeader().Nested {
+		switch v := ele.(type) {
+		case *T:
+			return v
+		case T:
+			return &v
+		}
+	}
+	return nil
+}
+
+// FindAllNested returns all the elements nested in the stanza which
+// are of type T or *T.
+func FindAllNested[T any](st Stanza) []*T {
+	var all []*T
+	for _, ele := range st.GetHeader().Nested {
+		switch v := ele.(type) {
+		case *T:
+			all = append(all, v)
+		case T:
+			all = append(all, &v)
+		}
+	}
+	return all
+}
+
+// ValidateStanza checks the elements nested in an outgoing
+// stanza. Each must marshal to a namespace-qualified element outside
+// jabber:client, and if an extension has registered a type for that
+// element name, it must be of that type. SendStanza refuses stanzas
+// which fail this check. Those sent on Client.Send are sent anyway,
+// as they always have been, and a warning is logged.
+func (cl *Client) ValidateStanza(st Stanza) error {
+	return validateNested(st.GetHeader(), cl.payloads)
+}
+
+func validateNested(hdr *Header, types map[xml.Name]reflect.Type) error {
+	for _, ele := range hdr.Nested {
+		name, ok := xmlName(ele)
+		if !ok {
+			return fmt.Errorf("no XML name for nested %T", ele)
+		}
+		if name.Space == "" || name.Space == NsClient {
+			return fmt.Errorf("nested %s not namespace-qualified",
+				name.Local)
+		}
+		typ := reflect.TypeOf(ele)
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if typ == reflect.TypeOf(Generic{}) {
+			continue
+		}
+		if want, ok := types[name]; ok && want != typ {
+			return fmt.Errorf("nested %s %s is %v, want %v",
+				name.Space, name.Local, typ, want)
+		}
+	}
+	return nil
+}
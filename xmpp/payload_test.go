@@ -0,0 +1,71 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestRegisterPayload(t *testing.T) {
+	ext := Extension{}
+	RegisterPayload[RosterQuery](&ext)
+	typ := ext.StanzaTypes[xml.Name{Space: NsRoster, Local: "query"}]
+	if typ != reflect.TypeOf(RosterQuery{}) {
+		t.Errorf("registered %v", typ)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic for unqualified payload")
+		}
+	}()
+	RegisterPayload[Text](&ext)
+}
+
+func TestFindNested(t *testing.T) {
+	rq := &RosterQuery{Item: []RosterItem{{Jid: "a@b.c"}}}
+	iq := &Iq{Header: Header{Nested: []interface{}{
+		Generic{}, rq, RosterQuery{}}}}
+	if FindNested[RosterQuery](iq) != rq {
+		t.Error("didn't find pointer")
+	}
+	if n := len(FindAllNested[RosterQuery](iq)); n != 2 {
+		t.Errorf("found %d", n)
+	}
+	if FindNested[bindIq](iq) != nil {
+		t.Error("found bind")
+	}
+}
+
+func TestValidateNested(t *testing.T) {
+	types := make(map[xml.Name]reflect.Type)
+	types[xml.Name{Space: NsRoster, Local: "query"}] =
+		reflect.TypeOf(RosterQuery{})
+	good := []interface{}{
+		RosterQuery{},
+		&RosterQuery{},
+		&bindIq{},
+		&Generic{XMLName: xml.Name{Space: NsRoster, Local: "query"}},
+	}
+	for _, n := range good {
+		hdr := &Header{Nested: []interface{}{n}}
+		if err := validateNested(hdr, types); err != nil {
+			t.Errorf("%T: %v", n, err)
+		}
+	}
+	type fakeQuery struct {
+		XMLName xml.Name `xml:"jabber:iq:roster query"`
+	}
+	bad := []interface{}{
+		nil,
+		"string",
+		&Text{XMLName: xml.Name{Local: "body"}},
+		&fakeQuery{},
+	}
+	for _, n := range bad {
+		hdr := &Header{Nested: []interface{}{n}}
+		if err := validateNested(hdr, types); err == nil {
+			t.Errorf("%T: no error", n)
+		}
+	}
+}
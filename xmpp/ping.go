@@ -0,0 +1,146 @@
+package xmpp
+
+// This file contains support for XMPP Ping, XEP-0199, and for keeping
+// the connection alive.
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Returned when a ping isn't answered in time.
+var ErrPingTimeout = errors.New("xmpp: ping timed out")
+
+// XEP-0199 ping request.
+type Ping struct {
+	XMLName xml.Name `xml:"urn:xmpp:ping ping"`
+}
+
+// WithKeepalive has the client ping the server every interval once
+// the session is running. If a ping isn't answered within timeout,
+// the connection is declared dead: the client's status becomes
+// StatusError.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(cl *Client) {
+		cl.keepInterval = interval
+		cl.keepTimeout = timeout
+		cl.keepWhitespace = false
+	}
+}
+
+// WithWhitespaceKeepalive has the client send a single space every
+// interval once the session is running, which is enough to stop
+// intermediaries from timing out an idle connection. Unlike
+// WithKeepalive, this only detects a dead connection if the operating
+// system reports the failure.
+func WithWhitespaceKeepalive(interval time.Duration) Option {
+	return func(cl *Client) {
+		cl.keepInterval = interval
+		cl.keepWhitespace = true
+	}
+}
+
+// The ping extension answers pings from others, and runs the
+// keepalive if one was asked for.
+func newPingExt(cl *Client) Extension {
+	ext := Extension{}
+	RegisterPayload[Ping](&ext)
+	ext.RecvInterceptor = func(st Stanza) (Stanza, bool) {
+		iq, ok := st.(*Iq)
+		if !ok || iq.Type != "get" || FindNested[Ping](iq) == nil {
+			return st, true
+		}
+		pong := &Iq{Header: Header{To: iq.From, Id: iq.Id,
+			Type: "result"}}
+		// Interceptors mustn't block.
+		cl.spawn(func() { cl.SendRaw(pong) })
+		return nil, false
+	}
+	ext.OnRunning = func(cl *Client) {
+		if cl.keepInterval > 0 {
+			status := cl.statmgr.newListener()
+			cl.spawn(func() { cl.keepalive(status) })
+		}
+	}
+	return ext
+}
+
+// Ping sends an XEP-0199 ping to another entity, or to our server if
+// to is empty, and waits up to timeout for the answer. An error reply
+// is returned as an *Error, and no reply as ErrPingTimeout.
+func (cl *Client) Ping(to JID, timeout time.Duration) error {
+	reply := cl.sendPing(to)
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-reply:
+		return err
+	case <-t.C:
+		return ErrPingTimeout
+	}
+}
+
+// Send a ping. The answer is delivered on the returned channel.
+func (cl *Client) sendPing(to JID) <-chan error {
+	if to == "" {
+		to = JID(cl.Jid.Domain())
+	}
+	reply := make(chan error, 1)
+	iq := &Iq{Header: Header{To: to, Id: cl.NextId(), Type: "get",
+		Nested: []interface{}{&Ping{}}}}
+	cl.SetIqCallback(iq, func(st Stanza) {
+		iq, ok := st.(*Iq)
+		switch {
+		case !ok:
+			reply <- ErrPingTimeout
+		case iq.Type == "error" && iq.Error != nil:
+			reply <- iq.Error
+		case iq.Type == "error":
+			reply <- fmt.Errorf("ping failed")
+		default:
+			reply <- nil
+		}
+	})
+	if err := cl.SendRaw(iq); err != nil {
+		reply <- err
+	}
+	return reply
+}
+
+func (cl *Client) keepalive(status <-chan Status) {
+	tick := time.NewTicker(cl.keepInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case stat, ok := <-status:
+			if !ok || stat.Fatal() {
+				return
+			}
+			continue
+		case <-tick.C:
+		}
+		if cl.keepWhitespace {
+			cl.SendRaw(&whitespace{})
+			continue
+		}
+		reply := cl.sendPing("")
+		t := time.NewTimer(cl.keepTimeout)
+		select {
+		case stat, ok := <-status:
+			t.Stop()
+			if !ok || stat.Fatal() {
+				return
+			}
+		case <-reply:
+			// Any answer, even an error, shows the
+			// connection is alive.
+			t.Stop()
+		case <-t.C:
+			cl.setError(fmt.Errorf("keepalive: %w",
+				ErrPingTimeout))
+			return
+		}
+	}
+}
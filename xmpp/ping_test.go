@@ -0,0 +1,88 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Answer pings from the client, unless told to drop them.
+func pingHandler(drop bool) func(fs *fakeServer, e *rawElem) bool {
+	return func(fs *fakeServer, e *rawElem) bool {
+		if e.XMLName.Local != "iq" || !strings.Contains(e.Inner, NsPing) {
+			return false
+		}
+		if !drop {
+			fs.write(fmt.Sprintf(`<iq type="result" id="%s" `+
+				`from="example.com"/>`, e.attr("id")))
+		}
+		return true
+	}
+}
+
+func TestAnswerPing(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client()
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	fs.write(`<iq type="get" id="p1" from="example.com">` +
+		`<ping xmlns="` + NsPing + `"/></iq>`)
+	e := fs.next()
+	if e.XMLName.Local != "iq" || e.attr("type") != "result" ||
+		e.attr("id") != "p1" || e.attr("to") != "example.com" {
+		t.Errorf("got %s %v", e.XMLName.Local, e.Attrs)
+	}
+}
+
+func TestPing(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	var drop atomic.Bool
+	fs.handle = func(fs *fakeServer, e *rawElem) bool {
+		return pingHandler(drop.Load())(fs, e)
+	}
+	cl := fs.client()
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	if err := cl.Ping("", time.Second); err != nil {
+		t.Error(err)
+	}
+	drop.Store(true)
+	if err := cl.Ping("", 50*time.Millisecond); err != ErrPingTimeout {
+		t.Errorf("unanswered ping: %v", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.handle = pingHandler(true)
+	cl := fs.client(WithKeepalive(20*time.Millisecond,
+		20*time.Millisecond))
+	defer cl.Close()
+	drain(cl)
+	status := cl.statmgr.newListener()
+	timeout := time.After(5 * time.Second)
+	for stat := StatusRunning; stat != StatusError; {
+		select {
+		case stat = <-status:
+		case <-timeout:
+			t.Fatal("no error")
+		}
+	}
+	if err := cl.getError(nil); !errors.Is(err, ErrPingTimeout) {
+		t.Errorf("error %v", err)
+	}
+}
+
+func TestWriteWhitespace(t *testing.T) {
+	assertEquals(t, " ", testWrite(&whitespace{}))
+}
@@ -0,0 +1,263 @@
+package xmpp
+
+// This file contains tracking of the presence of other entities, RFC
+// 6121, Section 4.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// PresenceTracker keeps the latest presence of each entity which has
+// sent us one, by full JID, and works out the best resource of each
+// contact to talk to. Everyone is forgotten when a session starts or
+// ends.
+type PresenceTracker struct {
+	Extension
+	// New subscribers to presence events.
+	subscribe chan *subscriber[PresenceEvent]
+	// Functions to run against the manager's presences.
+	lookup chan func(map[JID]tracked)
+	// Tells the manager to forget everyone.
+	reset chan struct{}
+	// Closed when the manager stops.
+	done chan struct{}
+	cl   *Client
+}
+
+// A change in the presence of one resource.
+type PresenceEvent struct {
+	// The full JID whose presence changed.
+	Jid JID
+	// The presence received. For an entity going offline, this is
+	// its unavailable or error presence, or nil if it was
+	// forgotten at the start or end of a session.
+	Presence *Presence
+	// Whether the resource is now available.
+	Available bool
+}
+
+// The latest presence from a resource, and when it arrived, counting
+// presences.
+type tracked struct {
+	pr  *Presence
+	seq uint64
+}
+
+// The priority of a presence. RFC 6121, Section 4.7.2.3.
+func presencePriority(pr *Presence) int {
+	if pr.Priority == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(pr.Priority.Chardata))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// How keen a resource is to talk, by its show element. RFC 6121,
+// Section 4.7.2.1.
+func presenceEagerness(pr *Presence) int {
+	show := ""
+	if pr.Show != nil {
+		show = pr.Show.Chardata
+	}
+	switch show {
+	case "chat":
+		return 4
+	case "":
+		return 3
+	case "away":
+		return 2
+	case "xa":
+		return 1
+	}
+	return 0
+}
+
+func (p *PresenceTracker) presenceMgr(upd <-chan Stanza) {
+	defer close(p.done)
+	presences := make(map[JID]tracked)
+	var seq uint64
+	var subs []*subscriber[PresenceEvent]
+	defer func() {
+		for _, s := range subs {
+			s.close()
+		}
+	}()
+	for {
+		select {
+		case f := <-p.lookup:
+			f(presences)
+
+		case s := <-p.subscribe:
+			// Start the subscriber off with who's
+			// already online.
+			var evs []PresenceEvent
+			for jid, t := range presences {
+				evs = append(evs, PresenceEvent{Jid: jid,
+					Presence: t.pr, Available: true})
+			}
+			if len(evs) == 0 || s.send(evs) {
+				subs = append(subs, s)
+			}
+
+		case <-p.reset:
+			var evs []PresenceEvent
+			for jid := range presences {
+				evs = append(evs, PresenceEvent{Jid: jid})
+			}
+			presences = make(map[JID]tracked)
+			subs = publish(subs, evs)
+
+		case stan, ok := <-upd:
+			if !ok {
+				return
+			}
+			pr, ok := stan.(*Presence)
+			if !ok || pr.From == "" {
+				continue
+			}
+			var evs []PresenceEvent
+			switch pr.Type {
+			case "":
+				seq++
+				presences[pr.From] = tracked{pr, seq}
+				evs = append(evs, PresenceEvent{Jid: pr.From,
+					Presence: pr, Available: true})
+			case "unavailable", "error":
+				// An error from a bare JID takes all
+				// its resources offline.
+				for jid := range presences {
+					if jid == pr.From ||
+						(pr.Type == "error" &&
+							pr.From == pr.From.Bare() &&
+							jid.Bare() == pr.From) {
+						delete(presences, jid)
+						evs = append(evs, PresenceEvent{
+							Jid: jid, Presence: pr})
+					}
+				}
+			}
+			subs = publish(subs, evs)
+		}
+	}
+}
+
+func (p *PresenceTracker) makeFilter() Filter {
+	presenceUpdate := make(chan Stanza)
+	go p.presenceMgr(presenceUpdate)
+	return func(in <-chan Stanza, out chan<- Stanza) {
+		defer close(out)
+		defer close(presenceUpdate)
+		for stan := range in {
+			if _, ok := stan.(*Presence); ok {
+				presenceUpdate <- stan
+			}
+			out <- stan
+		}
+	}
+}
+
+func newPresenceExt() *PresenceTracker {
+	p := PresenceTracker{}
+	p.subscribe = make(chan *subscriber[PresenceEvent])
+	p.lookup = make(chan func(map[JID]tracked))
+	p.reset = make(chan struct{})
+	p.done = make(chan struct{})
+	p.OnRunning = func(cl *Client) { p.forget() }
+	p.OnShutdown = func(cl *Client) { p.forget() }
+	p.RecvFilter = p.makeFilter()
+	return &p
+}
+
+// Forget everyone, telling subscribers they've gone offline.
+func (p *PresenceTracker) forget() {
+	select {
+	case p.reset <- struct{}{}:
+	case <-p.done:
+	}
+}
+
+// Subscribe returns a channel on which changes in presence are
+// delivered, starting with an event for each resource already
+// available. Events are queued for as long as the caller takes to read
+// them. The channel is closed when the client shuts down, or after the
+// returned function is called to unsubscribe.
+func (p *PresenceTracker) Subscribe() (<-chan PresenceEvent, func()) {
+	s := newSubscriber[PresenceEvent](p.cl.deliveries)
+	select {
+	case p.subscribe <- s:
+	case <-p.done:
+		s.close()
+	}
+	return s.out, s.cancel
+}
+
+// Run f against the manager's presences. Returns false if the manager
+// has stopped.
+func (p *PresenceTracker) query(f func(map[JID]tracked)) bool {
+	done := make(chan struct{})
+	select {
+	case p.lookup <- func(presences map[JID]tracked) {
+		f(presences)
+		close(done)
+	}:
+		<-done
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// Get returns the latest presence from a full JID, or nil if it isn't
+// available.
+func (p *PresenceTracker) Get(jid JID) *Presence {
+	var pr *Presence
+	p.query(func(presences map[JID]tracked) {
+		pr = presences[jid].pr
+	})
+	return pr
+}
+
+// Resources returns the latest presence of each available resource
+// of a bare JID.
+func (p *PresenceTracker) Resources(bare JID) []*Presence {
+	var prs []*Presence
+	p.query(func(presences map[JID]tracked) {
+		for jid, t := range presences {
+			if jid.Bare() == bare {
+				prs = append(prs, t.pr)
+			}
+		}
+	})
+	return prs
+}
+
+// Best returns the presence of the resource of a bare JID which is
+// best to talk to, or nil if none is available. That's the one with
+// the highest priority, then the keenest to talk, by its show
+// element, and then the one we heard from most recently.
+func (p *PresenceTracker) Best(bare JID) *Presence {
+	var best tracked
+	p.query(func(presences map[JID]tracked) {
+		for jid, t := range presences {
+			if jid.Bare() == bare &&
+				(best.pr == nil || t.betterThan(best)) {
+				best = t
+			}
+		}
+	})
+	return best.pr
+}
+
+func (t tracked) betterThan(u tracked) bool {
+	if a, b := presencePriority(t.pr), presencePriority(u.pr); a != b {
+		return a > b
+	}
+	if a, b := presenceEagerness(t.pr), presenceEagerness(u.pr); a != b {
+		return a > b
+	}
+	return t.seq > u.seq
+}
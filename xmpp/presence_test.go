@@ -0,0 +1,89 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func nextPresenceEvent(t *testing.T, evs <-chan PresenceEvent) PresenceEvent {
+	select {
+	case ev, ok := <-evs:
+		if !ok {
+			t.Fatal("events closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no presence event")
+	}
+	return PresenceEvent{}
+}
+
+func TestPresenceTracker(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client()
+	drain(cl)
+	fs.next()
+	evs, _ := cl.Presences.Subscribe()
+
+	fs.write(`<presence from="a@b.c/phone"><priority>1</priority>` +
+		`<show>away</show></presence>` +
+		`<presence from="a@b.c/desk"><priority>1</priority></presence>` +
+		`<presence from="a@b.c/bot"><priority>-1</priority></presence>`)
+	for i := 0; i < 3; i++ {
+		if ev := nextPresenceEvent(t, evs); !ev.Available {
+			t.Errorf("event %+v", ev)
+		}
+	}
+	if pr := cl.Presences.Best("a@b.c"); pr == nil || pr.From != "a@b.c/desk" {
+		t.Errorf("best %v", pr)
+	}
+	if n := len(cl.Presences.Resources("a@b.c")); n != 3 {
+		t.Errorf("%d resources", n)
+	}
+
+	// The most recent wins a tie.
+	fs.write(`<presence from="a@b.c/phone"><priority>1</priority>` +
+		`</presence>`)
+	nextPresenceEvent(t, evs)
+	if pr := cl.Presences.Best("a@b.c"); pr == nil || pr.From != "a@b.c/phone" {
+		t.Errorf("best %v", pr)
+	}
+
+	fs.write(`<presence from="a@b.c/phone" type="unavailable"/>`)
+	ev := nextPresenceEvent(t, evs)
+	if ev.Available || ev.Jid != "a@b.c/phone" || ev.Presence == nil {
+		t.Errorf("unavailable %+v", ev)
+	}
+	if pr := cl.Presences.Get("a@b.c/phone"); pr != nil {
+		t.Errorf("phone %v", pr)
+	}
+	if pr := cl.Presences.Best("a@b.c"); pr == nil || pr.From != "a@b.c/desk" {
+		t.Errorf("best %v", pr)
+	}
+
+	// An error from the bare JID takes everything offline.
+	fs.write(`<presence from="a@b.c" type="error"/>`)
+	nextPresenceEvent(t, evs)
+	nextPresenceEvent(t, evs)
+	if pr := cl.Presences.Best("a@b.c"); pr != nil {
+		t.Errorf("best %v", pr)
+	}
+
+	// Shutting down forgets everyone.
+	fs.write(`<presence from="d@b.c/r"/>`)
+	nextPresenceEvent(t, evs)
+	closed := make(chan struct{})
+	go func() {
+		cl.Close()
+		close(closed)
+	}()
+	ev = nextPresenceEvent(t, evs)
+	if ev.Available || ev.Jid != "d@b.c/r" || ev.Presence != nil {
+		t.Errorf("shutdown %+v", ev)
+	}
+	if _, ok := <-evs; ok {
+		t.Error("events not closed")
+	}
+	<-closed
+}
@@ -0,0 +1,173 @@
+package xmpp
+
+// This file contains the queue of outgoing stanzas, which feeds the
+// send filters.
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+var (
+	// Returned by SendStanza before the session is running, or
+	// after it has failed.
+	ErrNotRunning = errors.New("xmpp: client not running")
+	// Returned by SendStanza when the send queue is full and its
+	// policy is QueueFail.
+	ErrQueueFull = errors.New("xmpp: send queue full")
+)
+
+// What SendStanza does when the send queue is full.
+type QueuePolicy int
+
+const (
+	// Wait for room in the queue.
+	QueueBlock QueuePolicy = iota
+	// Discard the oldest stanza in the queue to make room.
+	QueueDropOldest
+	// Return ErrQueueFull.
+	QueueFail
+)
+
+// The size of the send queue, by default.
+const DefaultQueueSize = 100
+
+// WithSendQueue sets the size of the queue of stanzas waiting to be
+// sent, and what SendStanza does when it's full. By default the queue
+// holds DefaultQueueSize stanzas, and SendStanza waits for room. A
+// queue of size 0 holds nothing that could be dropped, so with it
+// QueueDropOldest is treated as QueueBlock.
+func WithSendQueue(size int, policy QueuePolicy) Option {
+	return func(cl *Client) {
+		if size <= 0 && policy == QueueDropOldest {
+			policy = QueueBlock
+		}
+		cl.queueSize = size
+		cl.queuePolicy = policy
+	}
+}
+
+// SendStanza queues a stanza to be sent to the server. It returns
+// ErrNotRunning if the session isn't running, ErrClosed once Close
+// has been called, ErrQueueFull if the queue is full and its policy
+// is QueueFail, and the error from ValidateStanza if the stanza is
+// invalid. It's safe to call from any goroutine, at any time.
+func (cl *Client) SendStanza(st Stanza) error {
+	if cl.status() != StatusRunning {
+		if cl.isSendClosed() {
+			return ErrClosed
+		}
+		return ErrNotRunning
+	}
+	if err := cl.ValidateStanza(st); err != nil {
+		return err
+	}
+	return cl.enqueue(st, cl.queuePolicy, nil)
+}
+
+func (cl *Client) isSendClosed() bool {
+	cl.sendLock.RLock()
+	defer cl.sendLock.RUnlock()
+	return cl.sendClosed
+}
+
+// Add a stanza to the queue. With QueueBlock, give up when timeout
+// fires.
+func (cl *Client) enqueue(st Stanza, policy QueuePolicy,
+	timeout <-chan time.Time) error {
+
+	cl.sendLock.RLock()
+	defer cl.sendLock.RUnlock()
+	if cl.sendClosed {
+		return ErrClosed
+	}
+	// Counted before it's queued, so it can't be taken off the
+	// queue first.
+	cl.stats().AddQueued(1)
+	var err error
+	switch policy {
+	case QueueFail:
+		select {
+		case cl.queue <- st:
+		default:
+			err = ErrQueueFull
+		}
+	case QueueDropOldest:
+		for done := false; !done; {
+			select {
+			case cl.queue <- st:
+				done = true
+			default:
+				select {
+				case old := <-cl.queue:
+					cl.stats().AddQueued(-1)
+					cl.logAttrs(slog.LevelWarn,
+						"dropped queued stanza",
+						stanzaAttrs(TraceSend,
+							old)...)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case cl.queue <- st:
+		case <-cl.sendQuit:
+			err = ErrClosed
+		case <-timeout:
+			err = ErrQueueFull
+		}
+	}
+	if err != nil {
+		cl.stats().AddQueued(-1)
+	}
+	return err
+}
+
+// Stop accepting stanzas. Those already queued are still sent.
+func (cl *Client) closeQueue() {
+	close(cl.sendQuit)
+	cl.sendLock.Lock()
+	cl.sendClosed = true
+	cl.sendLock.Unlock()
+	close(cl.sendFlush)
+}
+
+// Move stanzas from the queue, and from Client.Send, to the send
+// filters. Once the queue is closed, whatever's left in it is sent,
+// and the filters' input is closed. After that, anything sent to
+// Client.Send is discarded, so the sender doesn't block forever.
+func (cl *Client) sendQueue(out chan<- Stanza) {
+	defer close(out)
+	for {
+		select {
+		case st := <-cl.queue:
+			cl.stats().AddQueued(-1)
+			out <- st
+		case st := <-cl.send:
+			out <- st
+		case <-cl.sendFlush:
+			for {
+				select {
+				case st := <-cl.queue:
+					cl.stats().AddQueued(-1)
+					out <- st
+				default:
+					// Not tracked by spawn: the app
+					// may send at any time.
+					go cl.discardSend()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Read and discard what the app sends to Client.Send after Close.
+func (cl *Client) discardSend() {
+	for st := range cl.send {
+		cl.logAttrs(slog.LevelWarn, "discarded stanza sent after close",
+			stanzaAttrs(TraceSend, st)...)
+	}
+}
@@ -0,0 +1,98 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func testQueueClient(size int) *Client {
+	return &Client{queue: make(chan Stanza, size),
+		sendQuit: make(chan struct{}), sendFlush: make(chan struct{})}
+}
+
+func TestQueuePolicies(t *testing.T) {
+	first := &Message{Header: Header{Id: "1"}}
+	second := &Message{Header: Header{Id: "2"}}
+
+	cl := testQueueClient(1)
+	if err := cl.enqueue(first, QueueFail, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.enqueue(second, QueueFail, nil); err != ErrQueueFull {
+		t.Errorf("fail: %v", err)
+	}
+
+	cl = testQueueClient(1)
+	cl.enqueue(first, QueueDropOldest, nil)
+	if err := cl.enqueue(second, QueueDropOldest, nil); err != nil {
+		t.Errorf("drop oldest: %v", err)
+	}
+	if st := <-cl.queue; st != second {
+		t.Errorf("drop oldest kept %s", st.GetHeader().Id)
+	}
+
+	cl = testQueueClient(1)
+	cl.enqueue(first, QueueBlock, nil)
+	err := cl.enqueue(second, QueueBlock,
+		time.After(10*time.Millisecond))
+	if err != ErrQueueFull {
+		t.Errorf("block with timeout: %v", err)
+	}
+	errs := make(chan error)
+	go func() { errs <- cl.enqueue(second, QueueBlock, nil) }()
+	cl.closeQueue()
+	if err := <-errs; err != ErrClosed {
+		t.Errorf("block after close: %v", err)
+	}
+	if err := cl.enqueue(second, QueueFail, nil); err != ErrClosed {
+		t.Errorf("after close: %v", err)
+	}
+}
+
+func TestUnbufferedDropOldest(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client(WithSendQueue(0, QueueDropOldest))
+	drain(cl)
+	fs.next()
+	if cl.queuePolicy != QueueBlock {
+		t.Errorf("policy %v", cl.queuePolicy)
+	}
+	for _, id := range []string{"m1", "m2"} {
+		err := cl.SendStanza(&Message{Header: Header{Id: id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := fs.next(); e.attr("id") != id {
+			t.Errorf("server got %s", e.attr("id"))
+		}
+	}
+	start := time.Now()
+	cl.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Close took %v", d)
+	}
+}
+
+func TestSendStanza(t *testing.T) {
+	cl := &Client{}
+	if err := cl.SendStanza(&Message{}); err != ErrNotRunning {
+		t.Errorf("before running: %v", err)
+	}
+
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl = fs.client(WithSendQueue(1, QueueFail))
+	drain(cl)
+	fs.next()
+	if err := cl.SendStanza(&Message{Header: Header{Id: "m1"}}); err != nil {
+		t.Error(err)
+	}
+	if e := fs.next(); e.attr("id") != "m1" {
+		t.Errorf("server got %s", e.attr("id"))
+	}
+	cl.Close()
+	if err := cl.SendStanza(&Message{}); err != ErrClosed {
+		t.Errorf("after close: %v", err)
+	}
+}
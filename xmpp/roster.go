@@ -4,28 +4,106 @@ package xmpp
 
 import (
 	"encoding/xml"
+	"fmt"
+	"log/slog"
 	"reflect"
 )
 
 // Roster query/result
 type RosterQuery struct {
-	XMLName xml.Name     `xml:"jabber:iq:roster query"`
-	Item    []RosterItem `xml:"item"`
+	XMLName xml.Name `xml:"jabber:iq:roster query"`
+	// The roster version, if the server supports versioning. An
+	// empty version is sent when we have no copy of the roster.
+	// XEP-0237.
+	Ver  *string      `xml:"ver,attr"`
+	Item []RosterItem `xml:"item"`
 }
 
 // See RFC 3921, Section 7.1.
 type RosterItem struct {
 	XMLName      xml.Name `xml:"jabber:iq:roster item"`
 	Jid          JID      `xml:"jid,attr"`
-	Subscription string   `xml:"subscription,attr"`
-	Name         string   `xml:"name,attr"`
-	Group        []string
+	Subscription string   `xml:"subscription,attr,omitempty"`
+	Name         string   `xml:"name,attr,omitempty"`
+	// "subscribe" while our request to subscribe to the contact's
+	// presence is waiting for an answer.
+	Ask string `xml:"ask,attr,omitempty"`
+	// Whether we've pre-approved a subscription request from the
+	// contact. RFC 6121, Section 3.4.
+	Approved bool     `xml:"approved,attr,omitempty"`
+	Group    []string `xml:"group"`
 }
 
 type Roster struct {
 	Extension
 	get      chan []RosterItem
 	toServer chan Stanza
+	// Tells the manager about our roster request.
+	fetch chan *rosterFetch
+	// New subscribers to roster events.
+	subscribe chan *subscriber[RosterEvent]
+	// Functions to run against the manager's copy of the roster.
+	lookup chan func(map[JID]RosterItem)
+	// Closed when the manager stops.
+	done chan struct{}
+	cl   *Client
+}
+
+// The kind of change a RosterEvent reports.
+type RosterEventType int
+
+const (
+	// A contact was added to the roster.
+	RosterAdded RosterEventType = iota
+	// A contact's name, groups, or subscription changed.
+	RosterUpdated
+	// A contact was removed from the roster.
+	RosterRemoved
+)
+
+func (t RosterEventType) String() string {
+	switch t {
+	case RosterAdded:
+		return "added"
+	case RosterUpdated:
+		return "updated"
+	case RosterRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("RosterEventType(%d)", int(t))
+}
+
+// A change to the roster. Item is the contact as it is now, or as it
+// was before it was removed. Old is the contact before an update, and
+// is empty otherwise.
+type RosterEvent struct {
+	Type RosterEventType
+	Item RosterItem
+	Old  RosterItem
+}
+
+// RosterError is returned when a change to the roster is refused,
+// either by us or by the server. Condition is one of the stanza error
+// conditions of RFC 6120, Section 8.3.3. For instance, an empty group
+// name is "not-acceptable", and so is a name or group the server
+// finds too long. RFC 6121, Section 2.3.3.
+type RosterError struct {
+	Jid       JID
+	Condition string
+	// The error returned by the server, if it was the server
+	// which refused.
+	Err *Error
+}
+
+func (e *RosterError) Error() string {
+	return fmt.Sprintf("roster item %s: %s", e.Jid, e.Condition)
+}
+
+func (e *RosterError) Unwrap() error {
+	if e.Err == nil {
+		return nil
+	}
+	return e.Err
 }
 
 type rosterClient struct {
@@ -33,14 +111,108 @@ type rosterClient struct {
 	rosterUpdate chan<- RosterItem
 }
 
+// Our request for the roster, and the stored copy we had when we
+// made it.
+type rosterFetch struct {
+	id     string
+	store  RosterStore
+	ver    string
+	cached []RosterItem
+}
+
+// Reports whether two versions of a contact are the same.
+func sameRosterItem(a, b RosterItem) bool {
+	a.XMLName, b.XMLName = xml.Name{}, xml.Name{}
+	if len(a.Group) == 0 && len(b.Group) == 0 {
+		a.Group, b.Group = nil, nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
 func (r *Roster) rosterMgr(upd <-chan Stanza) {
+	defer close(r.done)
 	roster := make(map[JID]RosterItem)
 	var snapshot []RosterItem
 	var get chan<- []RosterItem
+	var lookup <-chan func(map[JID]RosterItem)
+	var fetch rosterFetch
+	var subs []*subscriber[RosterEvent]
+	defer func() {
+		for _, s := range subs {
+			s.close()
+		}
+	}()
+	// Apply changes to the roster. If full is set, the items are
+	// the whole roster, and contacts not among them are removed.
+	apply := func(items []RosterItem, full bool) {
+		var evs []RosterEvent
+		seen := make(map[JID]bool)
+		for _, item := range items {
+			seen[item.Jid] = true
+			old, had := roster[item.Jid]
+			switch item.Subscription {
+			case "none", "from", "to", "both":
+				roster[item.Jid] = item
+				if !had {
+					evs = append(evs, RosterEvent{
+						Type: RosterAdded, Item: item})
+				} else if !sameRosterItem(old, item) {
+					evs = append(evs, RosterEvent{
+						Type: RosterUpdated, Item: item,
+						Old: old})
+				}
+			case "remove":
+				if had {
+					delete(roster, item.Jid)
+					evs = append(evs, RosterEvent{
+						Type: RosterRemoved, Item: old})
+				}
+			}
+		}
+		if full {
+			for jid, old := range roster {
+				if !seen[jid] {
+					delete(roster, jid)
+					evs = append(evs, RosterEvent{
+						Type: RosterRemoved, Item: old})
+				}
+			}
+		}
+		snapshot = []RosterItem{}
+		for _, ri := range roster {
+			snapshot = append(snapshot, ri)
+		}
+		get = r.get
+		lookup = r.lookup
+		subs = publish(subs, evs)
+	}
 	for {
 		select {
 		case get <- snapshot:
 
+		case f := <-lookup:
+			f(roster)
+
+		case s := <-r.subscribe:
+			// Start the subscriber off with what we
+			// already have.
+			var evs []RosterEvent
+			for _, item := range roster {
+				evs = append(evs, RosterEvent{
+					Type: RosterAdded, Item: item})
+			}
+			if len(evs) == 0 || s.send(evs) {
+				subs = append(subs, s)
+			}
+
+		case f := <-r.fetch:
+			fetch = *f
+			if fetch.cached != nil {
+				// Serve the stored copy until the
+				// server tells us otherwise.
+				apply(fetch.cached, true)
+			}
+
 		case stan, ok := <-upd:
 			if !ok {
 				return
@@ -49,32 +221,39 @@ func (r *Roster) rosterMgr(upd <-chan Stanza) {
 			if !ok {
 				continue
 			}
-			if iq.Type != "result" && iq.Type != "set" {
-				continue
+			// Pushes have already been checked. The
+			// only result we want is the one for our
+			// roster request.
+			fetched := iq.Type != "set" && fetch.id != "" &&
+				iq.Id == fetch.id
+			if fetched {
+				// Whatever the answer, we have all
+				// the roster we're going to get.
+				get = r.get
+				lookup = r.lookup
 			}
-			var rq *RosterQuery
-			for _, ele := range iq.Nested {
-				if q, ok := ele.(*RosterQuery); ok {
-					rq = q
-					break
-				}
+			if iq.Type != "set" && !fetched {
+				continue
 			}
+			rq := FindNested[RosterQuery](iq)
 			if rq == nil {
+				// An empty result means our stored
+				// copy is current.
 				continue
 			}
-			for _, item := range rq.Item {
-				switch item.Subscription {
-				case "none", "from", "to", "both":
-					roster[item.Jid] = item
-				case "remove":
-					delete(roster, item.Jid)
-				}
+			// A fetched roster replaces what we had.
+			apply(rq.Item, fetched)
+			if rq.Ver != nil {
+				fetch.ver = *rq.Ver
 			}
-			snapshot = []RosterItem{}
-			for _, ri := range roster {
-				snapshot = append(snapshot, ri)
+			if fetch.store != nil {
+				err := fetch.store.Save(fetch.ver, snapshot)
+				if err != nil {
+					r.cl.logAttrs(slog.LevelWarn,
+						"can't save roster",
+						slog.Any("err", err))
+				}
 			}
-			get = r.get
 		}
 	}
 }
@@ -86,6 +265,12 @@ func (r *Roster) makeFilters() (Filter, Filter) {
 		defer close(out)
 		defer close(rosterUpdate)
 		for stan := range in {
+			iq, ok := stan.(*Iq)
+			if ok && iq.Type == "set" &&
+				FindNested[RosterQuery](iq) != nil &&
+				!r.answerPush(iq) {
+				continue
+			}
 			rosterUpdate <- stan
 			out <- stan
 		}
@@ -107,29 +292,209 @@ func (r *Roster) makeFilters() (Filter, Filter) {
 	return recv, send
 }
 
+// Answer a roster push. Only our server may send them; those from
+// anyone else are refused, and false is returned. RFC 6121, Section
+// 2.1.6.
+func (r *Roster) answerPush(iq *Iq) bool {
+	cl := r.cl
+	reply := &Iq{Header: Header{To: iq.From, Id: iq.Id,
+		Type: "result"}}
+	ok := iq.From == "" || iq.From == cl.Jid.Bare()
+	if !ok {
+		reply.Type = "error"
+		reply.Error = NewError("cancel", "service-unavailable")
+		cl.logAttrs(slog.LevelWarn, "refused roster push",
+			append(stanzaAttrs(TraceRecv, iq),
+				slog.String("from", string(iq.From)))...)
+	}
+	// Filters mustn't hold up the stanzas behind this one.
+	cl.spawn(func() { cl.SendRaw(reply) })
+	return ok
+}
+
 func newRosterExt() *Roster {
 	r := Roster{}
-	r.StanzaTypes = make(map[xml.Name]reflect.Type)
-	rName := xml.Name{Space: NsRoster, Local: "query"}
-	r.StanzaTypes[rName] = reflect.TypeOf(RosterQuery{})
-	r.RecvFilter, r.SendFilter = r.makeFilters()
+	RegisterPayload[RosterQuery](&r.Extension)
 	r.get = make(chan []RosterItem)
 	r.toServer = make(chan Stanza)
+	r.fetch = make(chan *rosterFetch)
+	r.subscribe = make(chan *subscriber[RosterEvent])
+	r.lookup = make(chan func(map[JID]RosterItem))
+	r.done = make(chan struct{})
+	r.RecvFilter, r.SendFilter = r.makeFilters()
 	return &r
 }
 
 // Return the most recent snapshot of the roster status. This is
 // updated automatically as roster updates are received from the
-// server. This function may block immediately after the XMPP
-// connection has been established, until the first roster update is
-// received from the server.
+// server. Get blocks until the first roster fetch has completed. Once
+// the client has shut down, it returns nil.
 func (r *Roster) Get() []RosterItem {
-	return <-r.get
+	select {
+	case items := <-r.get:
+		return items
+	case <-r.done:
+		return nil
+	}
+}
+
+// Subscribe returns a channel on which changes to the roster are
+// delivered, starting with a RosterAdded event for each contact
+// already known. Events are queued for as long as the caller takes to
+// read them. The channel is closed when the client shuts down, or
+// after the returned function is called to unsubscribe.
+func (r *Roster) Subscribe() (<-chan RosterEvent, func()) {
+	s := newSubscriber[RosterEvent](r.cl.deliveries)
+	select {
+	case r.subscribe <- s:
+	case <-r.done:
+		s.close()
+	}
+	return s.out, s.cancel
 }
 
-// Asynchronously fetch this entity's roster from the server.
-func (r *Roster) update() {
-	iq := &Iq{Header: Header{Type: "get", Id: NextId(),
-		Nested: []interface{}{RosterQuery{}}}}
+// Lookup returns the contact with the given bare JID, and whether
+// there is one. Like Get, it blocks until the first roster fetch has
+// completed.
+func (r *Roster) Lookup(jid JID) (RosterItem, bool) {
+	var item RosterItem
+	var ok bool
+	r.query(func(roster map[JID]RosterItem) {
+		item, ok = roster[jid]
+	})
+	return item, ok
+}
+
+// InGroup returns the contacts in the named group. Like Get, it
+// blocks until the first roster fetch has completed.
+func (r *Roster) InGroup(group string) []RosterItem {
+	var items []RosterItem
+	r.query(func(roster map[JID]RosterItem) {
+		for _, item := range roster {
+			for _, g := range item.Group {
+				if g == group {
+					items = append(items, item)
+					break
+				}
+			}
+		}
+	})
+	return items
+}
+
+// Run f against the manager's copy of the roster. Returns false if
+// the manager has stopped.
+func (r *Roster) query(f func(map[JID]RosterItem)) bool {
+	done := make(chan struct{})
+	select {
+	case r.lookup <- func(roster map[JID]RosterItem) {
+		f(roster)
+		close(done)
+	}:
+		<-done
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// Asynchronously fetch this entity's roster from the server. If
+// there's a stored copy, it's used in the meantime, and if the server
+// supports versioning, it only sends what has changed since then.
+func (r *Roster) update(id string) {
+	cl := r.cl
+	f := &rosterFetch{id: id, store: cl.rosterStore}
+	if f.store != nil {
+		ver, items, err := f.store.Load()
+		if err != nil {
+			cl.logAttrs(slog.LevelWarn, "can't load roster",
+				slog.Any("err", err))
+		} else {
+			f.ver, f.cached = ver, items
+		}
+	}
+	rq := &RosterQuery{}
+	if cl.Features != nil && cl.Features.Has(NsRosterVer, "ver") {
+		rq.Ver = &f.ver
+	} else {
+		// Our version means nothing to this server.
+		f.ver = ""
+	}
+	iq := &Iq{Header: Header{Type: "get", Id: id,
+		Nested: []interface{}{rq}}}
+	r.fetch <- f
 	r.toServer <- iq
 }
+
+// Add adds a contact to the roster, or replaces the contact with the
+// same JID, and waits for the server to accept the change. Only the
+// item's Jid, Name and Group are sent; subscriptions are managed by
+// the server. Get reflects the change once the server has pushed it
+// to us. RFC 6121, Section 2.3.
+func (r *Roster) Add(item RosterItem) error {
+	if err := checkRosterItem(item); err != nil {
+		return err
+	}
+	return r.set(RosterItem{Jid: item.Jid, Name: item.Name,
+		Group: item.Group})
+}
+
+// Update changes the name and groups of a contact already in the
+// roster, as Add does. If there's no such contact, it returns a
+// RosterError with the condition "item-not-found".
+func (r *Roster) Update(item RosterItem) error {
+	if _, ok := r.Lookup(item.Jid); !ok {
+		return &RosterError{Jid: item.Jid, Condition: "item-not-found"}
+	}
+	return r.Add(item)
+}
+
+// Remove deletes a contact from the roster, cancelling any
+// subscriptions in both directions, and waits for the server to
+// accept the change. RFC 6121, Section 2.5.
+func (r *Roster) Remove(jid JID) error {
+	if err := checkRosterItem(RosterItem{Jid: jid}); err != nil {
+		return err
+	}
+	return r.set(RosterItem{Jid: jid, Subscription: "remove"})
+}
+
+// Send a roster set and wait for the result.
+func (r *Roster) set(item RosterItem) error {
+	cl := r.cl
+	iq := &Iq{Header: Header{Type: "set", Id: cl.NextId(),
+		Nested: []interface{}{&RosterQuery{Item: []RosterItem{item}}}}}
+	res, err := cl.request(iq)
+	if err != nil {
+		return err
+	}
+	if res.Type == "error" {
+		re := &RosterError{Jid: item.Jid, Err: res.Error}
+		if res.Error != nil {
+			re.Condition = res.Error.Condition()
+		}
+		return re
+	}
+	return nil
+}
+
+// Check an item before asking the server to store it. RFC 6121,
+// Section 2.3.3.
+func checkRosterItem(item RosterItem) error {
+	if item.Jid.Domain() == "" || item.Jid.Resource() != "" {
+		return &RosterError{Jid: item.Jid, Condition: "jid-malformed"}
+	}
+	seen := make(map[string]bool)
+	for _, g := range item.Group {
+		if g == "" {
+			return &RosterError{Jid: item.Jid,
+				Condition: "not-acceptable"}
+		}
+		if seen[g] {
+			return &RosterError{Jid: item.Jid,
+				Condition: "bad-request"}
+		}
+		seen[g] = true
+	}
+	return nil
+}
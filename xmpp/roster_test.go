@@ -2,8 +2,12 @@ package xmpp
 
 import (
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 // This is mostly just tests of the roster data structures.
@@ -51,3 +55,324 @@ func TestRosterIqUnmarshal(t *testing.T) {
 	item := rq.Item[0]
 	assertEquals(t, "a@b.c", string(item.Jid))
 }
+
+// Answer roster sets, refusing names longer than 10 characters, and
+// push accepted changes back to the client.
+func rosterSetHandler(fs *fakeServer, e *rawElem) bool {
+	if strings.HasPrefix(e.attr("id"), "push") {
+		// The client's answer to our push.
+		return true
+	}
+	if e.XMLName.Local != "iq" || e.attr("type") != "set" ||
+		!strings.Contains(e.Inner, NsRoster) {
+		return false
+	}
+	var rq RosterQuery
+	xml.Unmarshal([]byte(e.Inner), &rq)
+	if len(rq.Item) != 1 || len(rq.Item[0].Name) > 10 {
+		fs.write(fmt.Sprintf(`<iq type="error" id="%s"><error `+
+			`type="modify"><not-acceptable xmlns="%s"/></error>`+
+			`</iq>`, e.attr("id"), NsStanzas))
+		return true
+	}
+	item := rq.Item[0]
+	if item.Subscription != "remove" {
+		item.Subscription = "none"
+	}
+	push, _ := xml.Marshal(&RosterQuery{Item: []RosterItem{item}})
+	fs.write(fmt.Sprintf(`<iq type="result" id="%s"/>`+
+		`<iq type="set" id="push%s">%s</iq>`, e.attr("id"),
+		e.attr("id"), push))
+	fs.recv <- e
+	return true
+}
+
+func waitRoster(t *testing.T, r *Roster, n int) []RosterItem {
+	timeout := time.After(5 * time.Second)
+	for {
+		items := r.Get()
+		if len(items) == n {
+			return items
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("roster %v", items)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestRosterChanges(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.handle = rosterSetHandler
+	cl := fs.client()
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+	if items := cl.Roster.Get(); len(items) != 0 {
+		t.Errorf("initial roster %v", items)
+	}
+
+	err := cl.Roster.Add(RosterItem{Jid: "a@b.c", Name: "A",
+		Subscription: "both", Group: []string{"Friends", "Work"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := fs.next()
+	if !strings.Contains(e.Inner, `<group>Friends</group>`) ||
+		strings.Contains(e.Inner, "both") {
+		t.Errorf("sent %s", e.Inner)
+	}
+	items := waitRoster(t, &cl.Roster, 1)
+	if items[0].Name != "A" || len(items[0].Group) != 2 {
+		t.Errorf("roster %v", items)
+	}
+
+	err = cl.Roster.Update(RosterItem{Jid: "a@b.c",
+		Name: "much too long"})
+	var re *RosterError
+	if !errors.As(err, &re) || re.Condition != "not-acceptable" ||
+		re.Err == nil {
+		t.Errorf("long name: %v", err)
+	}
+	err = cl.Roster.Update(RosterItem{Jid: "x@b.c", Name: "X"})
+	if !errors.As(err, &re) || re.Condition != "item-not-found" {
+		t.Errorf("update missing: %v", err)
+	}
+
+	if err := cl.Roster.Remove("a@b.c"); err != nil {
+		t.Fatal(err)
+	}
+	if e := fs.next(); !strings.Contains(e.Inner, `subscription="remove"`) {
+		t.Errorf("sent %s", e.Inner)
+	}
+	waitRoster(t, &cl.Roster, 0)
+}
+
+func TestCheckRosterItem(t *testing.T) {
+	bad := map[string]RosterItem{
+		"jid-malformed":  {Jid: "a@b.c/r"},
+		"not-acceptable": {Jid: "a@b.c", Group: []string{""}},
+		"bad-request":    {Jid: "a@b.c", Group: []string{"g", "g"}},
+	}
+	for cond, item := range bad {
+		err := checkRosterItem(item)
+		re, ok := err.(*RosterError)
+		if !ok || re.Condition != cond {
+			t.Errorf("%v: %v", item, err)
+		}
+	}
+	if err := checkRosterItem(RosterItem{Jid: "b.c",
+		Group: []string{"g"}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRosterEmptyResult(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.handle = func(fs *fakeServer, e *rawElem) bool {
+		if e.XMLName.Local == "iq" && e.attr("type") == "get" &&
+			strings.Contains(e.Inner, NsRoster) {
+			fs.write(fmt.Sprintf(`<iq type="result" id="%s"/>`,
+				e.attr("id")))
+			return true
+		}
+		return false
+	}
+	cl := fs.client()
+	defer cl.Close()
+	drain(cl)
+	done := make(chan []RosterItem)
+	go func() { done <- cl.Roster.Get() }()
+	select {
+	case items := <-done:
+		if len(items) != 0 {
+			t.Errorf("roster %v", items)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get blocked")
+	}
+}
+
+func TestRosterPush(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client()
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	pushes := []struct {
+		from, typ string
+	}{
+		{"evil@example.com", "error"},
+		{"user@example.com/other", "error"},
+		{"", "result"},
+		{"user@example.com", "result"},
+	}
+	for i, p := range pushes {
+		from := ""
+		if p.from != "" {
+			from = ` from="` + p.from + `"`
+		}
+		fs.write(fmt.Sprintf(`<iq type="set" id="p%d"%s>`+
+			`<query xmlns="%s"><item jid="c%d@b.c" `+
+			`subscription="none"/></query></iq>`, i, from,
+			NsRoster, i))
+		e := fs.next()
+		if e.attr("id") != fmt.Sprintf("p%d", i) ||
+			e.attr("type") != p.typ || e.attr("to") != p.from {
+			t.Errorf("push from %q: got %v", p.from, e.Attrs)
+		}
+		if p.typ == "error" &&
+			!strings.Contains(e.Inner, "service-unavailable") {
+			t.Errorf("push from %q: got %s", p.from, e.Inner)
+		}
+	}
+	for _, item := range waitRoster(t, &cl.Roster, 2) {
+		if item.Jid != "c2@b.c" && item.Jid != "c3@b.c" {
+			t.Errorf("roster has %s", item.Jid)
+		}
+	}
+}
+
+func TestFileRosterStore(t *testing.T) {
+	s := &FileRosterStore{Path: t.TempDir() + "/roster.xml"}
+	ver, items, err := s.Load()
+	if err != nil || ver != "" || items != nil {
+		t.Fatalf("empty store: %q %v %v", ver, items, err)
+	}
+	if err := s.Save("v1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ver, items, _ = s.Load(); ver != "v1" || items == nil {
+		t.Errorf("no items: %q %v", ver, items)
+	}
+	want := []RosterItem{{Jid: "a@b.c", Subscription: "both",
+		Name: "A", Group: []string{"g"}}}
+	if err := s.Save("v2", want); err != nil {
+		t.Fatal(err)
+	}
+	ver, items, err = s.Load()
+	if err != nil || ver != "v2" || len(items) != 1 ||
+		items[0].Jid != "a@b.c" || items[0].Group[0] != "g" {
+		t.Errorf("got %q %v %v", ver, items, err)
+	}
+}
+
+func TestRosterVersioning(t *testing.T) {
+	store := &FileRosterStore{Path: t.TempDir() + "/roster.xml"}
+	store.Save("v1", []RosterItem{{Jid: "a@b.c",
+		Subscription: "both"}})
+
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.features = `<ver xmlns="` + NsRosterVer + `"/>`
+	requested := make(chan string, 1)
+	fs.handle = func(fs *fakeServer, e *rawElem) bool {
+		if e.attr("type") != "get" ||
+			!strings.Contains(e.Inner, NsRoster) {
+			return false
+		}
+		requested <- e.Inner
+		// Nothing's changed, except for what's pushed.
+		fs.write(fmt.Sprintf(`<iq type="result" id="%s"/>`,
+			e.attr("id")))
+		return true
+	}
+	cl := fs.client(WithRosterStore(store))
+	defer cl.Close()
+	drain(cl)
+	if req := <-requested; !strings.Contains(req, `ver="v1"`) {
+		t.Errorf("request %s", req)
+	}
+	items := cl.Roster.Get()
+	if len(items) != 1 || items[0].Jid != "a@b.c" {
+		t.Errorf("cached roster %v", items)
+	}
+
+	fs.write(`<iq type="set" id="push1"><query xmlns="` + NsRoster +
+		`" ver="v2"><item jid="d@e.f" subscription="none"/>` +
+		`</query></iq>`)
+	waitRoster(t, &cl.Roster, 2)
+	ver, items, _ := store.Load()
+	if ver != "v2" || len(items) != 2 {
+		t.Errorf("stored %q %v", ver, items)
+	}
+}
+
+func nextRosterEvent(t *testing.T, evs <-chan RosterEvent) RosterEvent {
+	select {
+	case ev, ok := <-evs:
+		if !ok {
+			t.Fatal("events closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no roster event")
+	}
+	return RosterEvent{}
+}
+
+func TestRosterEvents(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.handle = rosterSetHandler
+	cl := fs.client()
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+	evs, cancel := cl.Roster.Subscribe()
+
+	cl.Roster.Add(RosterItem{Jid: "a@b.c", Name: "A",
+		Group: []string{"Work"}})
+	fs.next()
+	ev := nextRosterEvent(t, evs)
+	if ev.Type != RosterAdded || ev.Item.Name != "A" {
+		t.Errorf("add: %v %v", ev.Type, ev.Item)
+	}
+	if item, ok := cl.Roster.Lookup("a@b.c"); !ok || item.Name != "A" {
+		t.Errorf("lookup %v %v", item, ok)
+	}
+	if _, ok := cl.Roster.Lookup("x@b.c"); ok {
+		t.Error("found x@b.c")
+	}
+	if items := cl.Roster.InGroup("Work"); len(items) != 1 {
+		t.Errorf("Work %v", items)
+	}
+
+	// A second subscriber learns what's already there.
+	evs2, cancel2 := cl.Roster.Subscribe()
+	if ev := nextRosterEvent(t, evs2); ev.Type != RosterAdded ||
+		ev.Item.Jid != "a@b.c" {
+		t.Errorf("initial: %v %v", ev.Type, ev.Item)
+	}
+	cancel2()
+	for range evs2 {
+	}
+
+	cl.Roster.Update(RosterItem{Jid: "a@b.c", Name: "B",
+		Group: []string{"Home"}})
+	fs.next()
+	ev = nextRosterEvent(t, evs)
+	if ev.Type != RosterUpdated || ev.Item.Name != "B" ||
+		ev.Old.Name != "A" {
+		t.Errorf("update: %v %v %v", ev.Type, ev.Item, ev.Old)
+	}
+	if items := cl.Roster.InGroup("Work"); len(items) != 0 {
+		t.Errorf("Work %v", items)
+	}
+
+	cl.Roster.Remove("a@b.c")
+	fs.next()
+	ev = nextRosterEvent(t, evs)
+	if ev.Type != RosterRemoved || ev.Item.Name != "B" {
+		t.Errorf("remove: %v %v", ev.Type, ev.Item)
+	}
+	cancel()
+	if _, ok := <-evs; ok {
+		t.Error("event after cancel")
+	}
+}
@@ -0,0 +1,82 @@
+package xmpp
+
+// This file contains support for keeping a copy of the roster between
+// sessions. See XEP-0237.
+
+import (
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A RosterStore keeps a copy of the roster and its version between
+// sessions, so the roster is available as soon as the client starts,
+// and a server which supports roster versioning need only send what
+// has changed.
+type RosterStore interface {
+	// Load returns the stored version and items. If nothing has
+	// been stored, it returns nil items.
+	Load() (ver string, items []RosterItem, err error)
+	// Save replaces whatever was stored.
+	Save(ver string, items []RosterItem) error
+}
+
+// WithRosterStore has the client keep its roster in s.
+func WithRosterStore(s RosterStore) Option {
+	return func(cl *Client) {
+		cl.rosterStore = s
+	}
+}
+
+// FileRosterStore is a RosterStore which keeps the roster in a file,
+// as a jabber:iq:roster query element.
+type FileRosterStore struct {
+	Path string
+}
+
+func (s *FileRosterStore) Load() (string, []RosterItem, error) {
+	buf, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var rq RosterQuery
+	if err := xml.Unmarshal(buf, &rq); err != nil {
+		return "", nil, err
+	}
+	ver := ""
+	if rq.Ver != nil {
+		ver = *rq.Ver
+	}
+	if rq.Item == nil {
+		rq.Item = []RosterItem{}
+	}
+	return ver, rq.Item, nil
+}
+
+// Save writes the roster to a temporary file, then renames it, so
+// the stored copy is never half-written.
+func (s *FileRosterStore) Save(ver string, items []RosterItem) error {
+	buf, err := xml.Marshal(&RosterQuery{Ver: &ver, Item: items})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path),
+		filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
@@ -0,0 +1,274 @@
+package xmpp
+
+// A Router dispatches incoming stanzas to handler functions, in the
+// manner of http.ServeMux, so applications don't have to write their
+// own type switch over everything that arrives on Client.Recv.
+
+import (
+	"encoding/xml"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// A Handler processes a single stanza.
+type Handler func(Stanza)
+
+// Middleware wraps a Handler to add behavior such as logging, access
+// control or rate limiting. It may decide not to call the wrapped
+// handler at all.
+type Middleware func(Handler) Handler
+
+// A Matcher reports whether a route applies to a stanza.
+type Matcher func(Stanza) bool
+
+type route struct {
+	matchers []Matcher
+	handler  Handler
+}
+
+// A Router holds an ordered list of routes. Each stanza is given to
+// the handler of the first route whose matchers all accept it.
+type Router struct {
+	lock       sync.RWMutex
+	routes     []route
+	middleware []Middleware
+	// If non-nil, NotFound is called by Serve for stanzas which
+	// match no route.
+	NotFound Handler
+}
+
+// Creates an empty router.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle adds a route. The handler will be called for stanzas which
+// satisfy all of the matchers; with no matchers, it's called for
+// every stanza. Routes are tried in the order they were added.
+func (r *Router) Handle(h Handler, matchers ...Matcher) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes = append(r.routes, route{matchers: matchers, handler: h})
+}
+
+// Use adds middleware which wraps every handler, including
+// NotFound. The first middleware added is the outermost.
+func (r *Router) Use(mw ...Middleware) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Dispatch hands the stanza to the first matching route, and reports
+// whether there was one.
+func (r *Router) Dispatch(st Stanza) bool {
+	h := r.lookup(st)
+	if h == nil {
+		return false
+	}
+	h(st)
+	return true
+}
+
+// Serve dispatches every stanza received on ch, typically
+// Client.Recv, until the channel is closed. Stanzas which match no
+// route are given to NotFound.
+func (r *Router) Serve(ch <-chan Stanza) {
+	for st := range ch {
+		if r.Dispatch(st) {
+			continue
+		}
+		r.lock.RLock()
+		h := r.NotFound
+		r.lock.RUnlock()
+		if h != nil {
+			r.wrap(h)(st)
+		}
+	}
+}
+
+// Filter returns a filter which may be installed with
+// Client.AddRecvFilter or in an Extension. Stanzas which match a route
+// are consumed by the router; all others are passed on up the stack.
+func (r *Router) Filter() Filter {
+	return func(in <-chan Stanza, out chan<- Stanza) {
+		defer close(out)
+		for st := range in {
+			if !r.Dispatch(st) {
+				out <- st
+			}
+		}
+	}
+}
+
+func (r *Router) lookup(st Stanza) Handler {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+Routes:
+	for _, rt := range r.routes {
+		for _, m := range rt.matchers {
+			if !m(st) {
+				continue Routes
+			}
+		}
+		return r.wrapLocked(rt.handler)
+	}
+	return nil
+}
+
+func (r *Router) wrap(h Handler) Handler {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.wrapLocked(h)
+}
+
+func (r *Router) wrapLocked(h Handler) Handler {
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	return h
+}
+
+// MatchKind accepts stanzas whose element name is one of the given
+// kinds: "iq", "message" or "presence".
+func MatchKind(kinds ...string) Matcher {
+	return func(st Stanza) bool {
+		kind := stanzaKind(st)
+		for _, k := range kinds {
+			if k == kind {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchType accepts stanzas whose type attribute is one of the given
+// types. An empty string matches stanzas with no type.
+func MatchType(types ...string) Matcher {
+	return func(st Stanza) bool {
+		typ := st.GetHeader().Type
+		for _, t := range types {
+			if t == typ {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchFrom accepts stanzas whose sender matches the pattern. The
+// pattern is a JID which may contain the wildcards understood by
+// path.Match, such as "*@example.com". If the pattern has no resource
+// part it matches any resource of the sender.
+func MatchFrom(pattern string) Matcher {
+	pat := JID(pattern)
+	return func(st Stanza) bool {
+		from := st.GetHeader().From
+		ok, _ := path.Match(string(pat.Bare()), string(from.Bare()))
+		if !ok {
+			return false
+		}
+		if pat.Resource() == "" {
+			return true
+		}
+		ok, _ = path.Match(pat.Resource(), from.Resource())
+		return ok
+	}
+}
+
+// MatchNamespace accepts stanzas carrying a nested payload element
+// in the given XML namespace.
+func MatchNamespace(space string) Matcher {
+	return func(st Stanza) bool {
+		for _, name := range nestedNames(st.GetHeader()) {
+			if name.Space == space {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Returns "iq", "message", "presence", or the empty string.
+func stanzaKind(st Stanza) string {
+	switch st.(type) {
+	case *Iq:
+		return "iq"
+	case *Message:
+		return "message"
+	case *Presence:
+		return "presence"
+	}
+	return ""
+}
+
+// Find the names of the top-level elements nested in a stanza. Those
+// which were received are found in the inner XML; those which are
+// being sent are found in Nested.
+func nestedNames(hdr *Header) []xml.Name {
+	var names []xml.Name
+	p := xml.NewDecoder(strings.NewReader(hdr.Innerxml))
+	depth := 0
+	for {
+		t, err := p.Token()
+		if err != nil {
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				names = append(names, t.Name)
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	for _, n := range hdr.Nested {
+		if name, ok := xmlName(n); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Determine the element name a value will be marshalled with, from
+// its XMLName field or that field's struct tag.
+func xmlName(v interface{}) (xml.Name, bool) {
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return xml.Name{}, false
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return xml.Name{}, false
+	}
+	field, ok := val.Type().FieldByName("XMLName")
+	if !ok {
+		return xml.Name{}, false
+	}
+	name, ok := val.FieldByIndex(field.Index).Interface().(xml.Name)
+	if ok && name.Local != "" {
+		return name, true
+	}
+	return tagName(field.Tag.Get("xml"))
+}
+
+// Parse a struct tag of the form "space local".
+func tagName(tag string) (xml.Name, bool) {
+	if i := strings.Index(tag, ","); i >= 0 {
+		tag = tag[:i]
+	}
+	if tag == "" {
+		return xml.Name{}, false
+	}
+	if i := strings.LastIndex(tag, " "); i >= 0 {
+		return xml.Name{Space: tag[:i], Local: tag[i+1:]}, true
+	}
+	return xml.Name{Local: tag}, true
+}
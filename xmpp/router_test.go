@@ -0,0 +1,111 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestRouterDispatch(t *testing.T) {
+	r := NewRouter()
+	var got []string
+	r.Handle(func(st Stanza) { got = append(got, "chat") },
+		MatchKind("message"), MatchType("chat"))
+	r.Handle(func(st Stanza) { got = append(got, "alice") },
+		MatchFrom("alice@example.com"))
+	r.Handle(func(st Stanza) { got = append(got, "roster") },
+		MatchKind("iq"), MatchNamespace(NsRoster))
+
+	msg := &Message{Header: Header{From: "bob@example.com/x",
+		Type: "chat"}}
+	if !r.Dispatch(msg) {
+		t.Error("chat not dispatched")
+	}
+	pr := &Presence{Header: Header{From: "alice@example.com/home"}}
+	if !r.Dispatch(pr) {
+		t.Error("alice not dispatched")
+	}
+	iq := &Iq{Header: Header{Type: "set", Innerxml: `<query xmlns="` +
+		NsRoster + `"><item jid="a@b.c"/></query>`}}
+	if !r.Dispatch(iq) {
+		t.Error("roster push not dispatched")
+	}
+	iq = &Iq{Header: Header{Type: "get",
+		Nested: []interface{}{RosterQuery{}}}}
+	if !r.Dispatch(iq) {
+		t.Error("roster get not dispatched")
+	}
+	if r.Dispatch(&Presence{Header: Header{From: "bob@example.com"}}) {
+		t.Error("bob's presence was dispatched")
+	}
+	exp := []string{"chat", "alice", "roster", "roster"}
+	if len(got) != len(exp) {
+		t.Fatalf("got %v", got)
+	}
+	for i := range exp {
+		assertEquals(t, exp[i], got[i])
+	}
+}
+
+func TestMatchFrom(t *testing.T) {
+	st := &Message{Header: Header{From: "carol@muc.example.com/nick"}}
+	for pat, exp := range map[string]bool{
+		"carol@muc.example.com":       true,
+		"*@muc.example.com":           true,
+		"*@example.com":               false,
+		"carol@muc.example.com/nick":  true,
+		"carol@muc.example.com/other": false,
+		"carol@muc.example.com/n*":    true,
+	} {
+		if MatchFrom(pat)(st) != exp {
+			t.Errorf("%s: expected %v", pat, exp)
+		}
+	}
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	r := NewRouter()
+	var trace []string
+	mw := func(name string) Middleware {
+		return func(h Handler) Handler {
+			return func(st Stanza) {
+				trace = append(trace, name)
+				h(st)
+			}
+		}
+	}
+	r.Handle(func(st Stanza) { trace = append(trace, "handler") })
+	r.Use(mw("outer"), mw("inner"))
+	r.Dispatch(&Message{})
+	exp := []string{"outer", "inner", "handler"}
+	if len(trace) != len(exp) {
+		t.Fatalf("got %v", trace)
+	}
+	for i := range exp {
+		assertEquals(t, exp[i], trace[i])
+	}
+}
+
+func TestRouterFilter(t *testing.T) {
+	r := NewRouter()
+	handled := 0
+	r.Handle(func(st Stanza) { handled++ }, MatchKind("iq"))
+	r.NotFound = func(st Stanza) { t.Errorf("NotFound called") }
+	in := make(chan Stanza)
+	out := make(chan Stanza)
+	go r.Filter()(in, out)
+	go func() {
+		in <- &Iq{}
+		in <- &Message{XMLName: xml.Name{Local: "message"}}
+		close(in)
+	}()
+	n := 0
+	for st := range out {
+		if _, ok := st.(*Message); !ok {
+			t.Errorf("unexpected %T", st)
+		}
+		n++
+	}
+	if n != 1 || handled != 1 {
+		t.Errorf("passed %d, handled %d", n, handled)
+	}
+}
@@ -32,13 +32,13 @@ func (cl *Client) chooseSasl(fe *Features) {
 	if digestMd5 {
 		auth := &auth{XMLName: xml.Name{Space: NsSASL, Local: "auth"},
 			Mechanism: "DIGEST-MD5"}
-		cl.sendRaw <- auth
+		cl.SendRaw(auth)
 	} else if plain {
 		raw := "\x00" + cl.Jid.Node() + "\x00" + cl.password
 		enc := base64.StdEncoding.EncodeToString([]byte(raw))
 		auth := &auth{XMLName: xml.Name{Space: NsSASL, Local: "auth"},
 			Mechanism: "PLAIN", Chardata: enc}
-		cl.sendRaw <- auth
+		cl.SendRaw(auth)
 	} else {
 		cl.setError(fmt.Errorf("No supported auth mechanism in %v",
 			mechs))
@@ -66,9 +66,7 @@ func (cl *Client) handleSasl(srv *auth) {
 		cl.setError(fmt.Errorf("SASL authentication failed"))
 	case "success":
 		cl.setStatus(StatusAuthenticated)
-		cl.Features = nil
-		ss := &stream{To: cl.Jid.Domain(), Version: XMPPVersion}
-		cl.sendRaw <- ss
+		cl.RestartStream()
 	}
 }
 
@@ -143,17 +141,17 @@ func (cl *Client) saslDigest1(srvMap map[string]string) {
 	b64 := base64.StdEncoding
 	clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "response"},
 		Chardata: b64.EncodeToString([]byte(clStr))}
-	cl.sendRaw <- clObj
+	cl.SendRaw(clObj)
 }
 
 func (cl *Client) saslDigest2(srvMap map[string]string) {
 	if cl.saslExpected == srvMap["rspauth"] {
 		clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "response"}}
-		cl.sendRaw <- clObj
+		cl.SendRaw(clObj)
 	} else {
 		clObj := &auth{XMLName: xml.Name{Space: NsSASL, Local: "failure"}, Any: &Generic{XMLName: xml.Name{Space: NsSASL,
 			Local: "abort"}}}
-		cl.sendRaw <- clObj
+		cl.SendRaw(clObj)
 	}
 }
 
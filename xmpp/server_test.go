@@ -0,0 +1,182 @@
+package xmpp
+
+// A minimal XMPP server for testing the client end to end. It offers
+// SASL PLAIN without TLS, binds whatever resource is asked for, and
+// answers session and roster requests. Everything else is handed to
+// the test.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A top-level element received by the fake server.
+type rawElem struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+func (e *rawElem) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+type fakeServer struct {
+	t    *testing.T
+	ln   net.Listener
+	lock sync.Mutex
+	conn net.Conn
+	// Stanzas the server didn't handle itself.
+	recv chan *rawElem
+	// Closed when the client ends its stream.
+	ended chan struct{}
+	// If set, the server doesn't answer the client's closing tag.
+	mute bool
+	// More features to offer after authentication.
+	features string
+	// If non-nil, called for each element before the default
+	// handling. Returns true if it handled the element.
+	handle func(fs *fakeServer, e *rawElem) bool
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeServer{t: t, ln: ln, recv: make(chan *rawElem, 100),
+		ended: make(chan struct{})}
+	go fs.serve()
+	return fs
+}
+
+// Connect a new client to the server.
+func (fs *fakeServer) client(opts ...Option) *Client {
+	jid := JID("user@example.com/res")
+	addr := fs.ln.Addr().(*net.TCPAddr)
+	cl, err := NewClientFromHost(&jid, "secret", nil, nil, Presence{},
+		nil, "127.0.0.1", addr.Port, opts...)
+	if err != nil {
+		fs.t.Fatalf("NewClientFromHost: %v", err)
+	}
+	return cl
+}
+
+// Discard whatever the client receives.
+func drain(cl *Client) {
+	go func() {
+		for range cl.Recv {
+		}
+	}()
+}
+
+func (fs *fakeServer) write(s string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	io.WriteString(fs.conn, s)
+}
+
+// Wait for the next stanza not handled by the server.
+func (fs *fakeServer) next() *rawElem {
+	select {
+	case e := <-fs.recv:
+		return e
+	case <-time.After(5 * time.Second):
+		fs.t.Fatal("timed out waiting for stanza")
+		return nil
+	}
+}
+
+func (fs *fakeServer) close() {
+	fs.ln.Close()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.conn != nil {
+		fs.conn.Close()
+	}
+}
+
+func (fs *fakeServer) serve() {
+	conn, err := fs.ln.Accept()
+	if err != nil {
+		return
+	}
+	fs.lock.Lock()
+	fs.conn = conn
+	fs.lock.Unlock()
+	dec := xml.NewDecoder(conn)
+	authed := false
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return
+		}
+		switch t := t.(type) {
+		case xml.EndElement:
+			if t.Name.Local == "stream" {
+				close(fs.ended)
+				if !fs.mute {
+					fs.write("</stream:stream>")
+				}
+				return
+			}
+		case xml.StartElement:
+			if t.Name.Local == "stream" {
+				fs.write(`<?xml version='1.0'?><stream:stream ` +
+					`xmlns="` + NsClient + `" xmlns:stream="` +
+					NsStream + `" from="example.com" id="s1" ` +
+					`version="1.0" xml:lang="en">`)
+				if authed {
+					fs.write(`<stream:features><bind xmlns="` +
+						NsBind + `"/><session xmlns="` +
+						NsSession + `"/>` + fs.features +
+						`</stream:features>`)
+				} else {
+					fs.write(`<stream:features><mechanisms xmlns="` +
+						NsSASL + `"><mechanism>PLAIN</mechanism>` +
+						`</mechanisms></stream:features>`)
+				}
+				continue
+			}
+			e := &rawElem{}
+			if err := dec.DecodeElement(e, &t); err != nil {
+				return
+			}
+			if fs.handle != nil && fs.handle(fs, e) {
+				continue
+			}
+			switch {
+			case e.XMLName.Local == "auth":
+				authed = true
+				fs.write(`<success xmlns="` + NsSASL + `"/>`)
+			case e.XMLName.Local == "iq" &&
+				strings.Contains(e.Inner, NsBind):
+				fs.write(fmt.Sprintf(`<iq type="result" id="%s">`+
+					`<bind xmlns="%s"><jid>user@example.com/res`+
+					`</jid></bind></iq>`, e.attr("id"), NsBind))
+			case e.XMLName.Local == "iq" &&
+				strings.Contains(e.Inner, NsSession):
+				fs.write(fmt.Sprintf(`<iq type="result" id="%s"/>`,
+					e.attr("id")))
+			case e.XMLName.Local == "iq" && e.attr("type") == "get" &&
+				strings.Contains(e.Inner, NsRoster):
+				fs.write(fmt.Sprintf(`<iq type="result" id="%s">`+
+					`<query xmlns="%s"/></iq>`, e.attr("id"),
+					NsRoster))
+			default:
+				fs.recv <- e
+			}
+		}
+	}
+}
@@ -4,6 +4,10 @@ package xmpp
 
 import (
 	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Status of the connection.
@@ -42,6 +46,24 @@ var (
 	StatusError Status = statusError
 )
 
+var statusNames = []string{
+	statusUnconnected:   "unconnected",
+	statusConnected:     "connected",
+	statusConnectedTls:  "connected-tls",
+	statusAuthenticated: "authenticated",
+	statusBound:         "bound",
+	statusRunning:       "running",
+	statusShutdown:      "shutdown",
+	statusError:         "error",
+}
+
+func (s Status) String() string {
+	if s >= 0 && int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
 // Does the status value indicate that the client is or has
 // disconnected?
 func (s Status) Fatal() bool {
@@ -56,17 +78,34 @@ func (s Status) Fatal() bool {
 type statmgr struct {
 	newStatus   chan Status
 	newlistener chan chan Status
+	// Closed to stop the manager, and by the manager when it has
+	// stopped.
+	quit, done chan struct{}
+	closeOnce  sync.Once
+	// Serializes status changes, so current is set in the
+	// order they're made.
+	setLock sync.Mutex
+	// The most recent status.
+	current atomic.Int32
+	// Told how long each status lasted.
+	metrics Metrics
 }
 
-func newStatmgr(client chan<- Status) *statmgr {
-	s := statmgr{}
+func newStatmgr(client chan<- Status, m Metrics) *statmgr {
+	s := statmgr{metrics: m}
+	if s.metrics == nil {
+		s.metrics = nopMetrics{}
+	}
 	s.newStatus = make(chan Status)
 	s.newlistener = make(chan chan Status)
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
 	go s.manager(client)
 	return &s
 }
 
 func (s *statmgr) manager(client chan<- Status) {
+	defer close(s.done)
 	// We handle this specially, in case the client doesn't read
 	// our final status message.
 	defer func() {
@@ -80,23 +119,30 @@ func (s *statmgr) manager(client chan<- Status) {
 	}()
 
 	stat := StatusUnconnected
+	since := time.Now()
 	listeners := []chan Status{}
 	for {
 		select {
-		case stat = <-s.newStatus:
+		case next := <-s.newStatus:
+			if next != stat {
+				now := time.Now()
+				s.metrics.ObserveStatus(stat, next,
+					now.Sub(since))
+				since = now
+			}
+			stat = next
 			for _, l := range listeners {
 				sendToListener(l, stat)
 			}
 			if client != nil && stat != StatusShutdown {
 				client <- stat
 			}
-		case l, ok := <-s.newlistener:
-			if !ok {
-				return
-			}
+		case l := <-s.newlistener:
 			defer close(l)
 			sendToListener(l, stat)
 			listeners = append(listeners, l)
+		case <-s.quit:
+			return
 		}
 	}
 }
@@ -112,21 +158,48 @@ func sendToListener(listen chan Status, stat Status) {
 }
 
 func (cl *Client) setStatus(stat Status) {
-	cl.statmgr.setStatus(stat)
+	cl.logAttrs(slog.LevelDebug, "status change",
+		slog.String("status", stat.String()))
+	if cl.statmgr != nil {
+		cl.statmgr.setStatus(stat)
+	}
 }
 
+// Returns the most recently set status.
+func (cl *Client) status() Status {
+	if cl.statmgr == nil {
+		return StatusUnconnected
+	}
+	return Status(cl.statmgr.current.Load())
+}
+
+// Status changes after the manager has stopped are discarded. The
+// current status is updated before this returns, so the caller sees
+// its own change.
 func (s *statmgr) setStatus(stat Status) {
-	s.newStatus <- stat
+	s.setLock.Lock()
+	defer s.setLock.Unlock()
+	select {
+	case s.newStatus <- stat:
+		s.current.Store(int32(stat))
+	case <-s.done:
+	}
 }
 
+// Returns a channel on which the current status and all subsequent
+// changes will be sent. It's closed when the manager stops.
 func (s *statmgr) newListener() <-chan Status {
 	l := make(chan Status, 1)
-	s.newlistener <- l
+	select {
+	case s.newlistener <- l:
+	case <-s.done:
+		close(l)
+	}
 	return l
 }
 
 func (s *statmgr) close() {
-	close(s.newlistener)
+	s.closeOnce.Do(func() { close(s.quit) })
 }
 
 func (s *statmgr) awaitStatus(waitFor Status) error {
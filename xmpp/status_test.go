@@ -6,7 +6,7 @@ import (
 )
 
 func TestStatusListen(t *testing.T) {
-	sm := newStatmgr(nil)
+	sm := newStatmgr(nil, nil)
 	l := sm.newListener()
 	stat, ok := <-l
 	if !ok {
@@ -39,7 +39,7 @@ func TestStatusListen(t *testing.T) {
 }
 
 func TestAwaitStatus(t *testing.T) {
-	sm := newStatmgr(nil)
+	sm := newStatmgr(nil, nil)
 
 	syncCh := make(chan int)
 
@@ -6,8 +6,6 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
-	"log"
-	"reflect"
 	"strings"
 )
 
@@ -31,6 +29,13 @@ type stream struct {
 
 var _ fmt.Stringer = &stream{}
 
+// The closing </stream:stream> tag.
+type streamEnd struct{}
+
+// Whitespace sent to keep the connection alive. RFC 6120, Section
+// 4.6.1.
+type whitespace struct{}
+
 // <stream:error>
 type streamError struct {
 	XMLName xml.Name `xml:"http://etherx.jabber.org/streams error"`
@@ -44,12 +49,20 @@ type errText struct {
 	Text    string   `xml:",chardata"`
 }
 
+// The stream features offered by the server.
 type Features struct {
 	Starttls   *starttls `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
 	Mechanisms mechs     `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
 	Bind       *bindIq
-	Session    *Generic
-	Any        *Generic
+	// Session establishment, RFC 3921, Section 3. Only old servers
+	// offer it.
+	Session *Generic `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	// Deprecated: never filled in. Use Other.
+	Any *Generic `xml:"-"`
+	// Features this library doesn't handle itself. Extensions may
+	// claim them; see Claim.
+	Other   []Generic `xml:",any"`
+	claimed map[xml.Name]bool
 }
 
 type starttls struct {
@@ -120,12 +133,73 @@ type Error struct {
 	XMLName xml.Name `xml:"error"`
 	// The error type attribute.
 	Type string `xml:"type,attr"`
-	// Any nested element, if present.
-	Any *Generic
+	// The defined condition, or any other nested element.
+	Any *Generic `xml:",any"`
+	// Descriptive text, if present.
+	Text *Text `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text"`
+	// Application-specific conditions, which follow the defined
+	// one. RFC 6120, Section 8.3.4.
+	AppSpecific []Generic `xml:",any"`
 }
 
 var _ error = &Error{}
 
+// UnmarshalXML puts the defined condition in Any, and the elements
+// which follow it in AppSpecific. Left to itself, encoding/xml would
+// put them all in Any, each overwriting the last.
+func (er *Error) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var raw struct {
+		XMLName xml.Name
+		Type    string    `xml:"type,attr"`
+		Any     []Generic `xml:",any"`
+		Text    *Text     `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text"`
+	}
+	if err := d.DecodeElement(&raw, &start); err != nil {
+		return err
+	}
+	*er = Error{XMLName: raw.XMLName, Type: raw.Type, Text: raw.Text}
+	if len(raw.Any) == 0 {
+		return nil
+	}
+	// Without a defined condition, Any gets whatever's first.
+	cond := 0
+	for i := range raw.Any {
+		if raw.Any[i].XMLName.Space == NsStanzas {
+			cond = i
+			break
+		}
+	}
+	er.Any = &raw.Any[cond]
+	for i := range raw.Any {
+		if i != cond {
+			er.AppSpecific = append(er.AppSpecific, raw.Any[i])
+		}
+	}
+	return nil
+}
+
+// Returns a stanza error of the given type ("cancel", "modify",
+// etc.) with one of the conditions defined in RFC 6120, Section
+// 8.3.3.
+func NewError(typ, condition string) *Error {
+	return &Error{Type: typ, Any: &Generic{XMLName: xml.Name{
+		Space: NsStanzas, Local: condition}}}
+}
+
+// Returns the error's defined condition, such as "item-not-found", or
+// "" if there is none.
+func (er *Error) Condition() string {
+	if er.Any != nil && er.Any.XMLName.Space == NsStanzas {
+		return er.Any.XMLName.Local
+	}
+	for _, g := range er.AppSpecific {
+		if g.XMLName.Space == NsStanzas {
+			return g.XMLName.Local
+		}
+	}
+	return ""
+}
+
 // Used for resource binding as a nested element inside <iq/>.
 type bindIq struct {
 	XMLName  xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
@@ -192,6 +266,38 @@ func (j JID) Bare() JID {
 	return JID(fmt.Sprintf("%s@%s", node, j.Domain()))
 }
 
+// Claim finds the feature with the given name among those this
+// library doesn't handle, and marks it as being negotiated by the
+// caller. Returns nil if the server didn't offer it, or if it has
+// already been claimed by another extension.
+func (fe *Features) Claim(space, local string) *Generic {
+	name := xml.Name{Space: space, Local: local}
+	if fe.claimed[name] {
+		return nil
+	}
+	for i := range fe.Other {
+		if fe.Other[i].XMLName == name {
+			if fe.claimed == nil {
+				fe.claimed = make(map[xml.Name]bool)
+			}
+			fe.claimed[name] = true
+			return &fe.Other[i]
+		}
+	}
+	return nil
+}
+
+// Has reports whether the server offered the feature with the given
+// name, whether or not it has been claimed.
+func (fe *Features) Has(space, local string) bool {
+	for _, g := range fe.Other {
+		if g.XMLName.Space == space && g.XMLName.Local == local {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *stream) String() string {
 	var buf bytes.Buffer
 	buf.WriteString(`<stream:stream xmlns="`)
@@ -275,8 +381,7 @@ func (u *Generic) String() string {
 func (er *Error) Error() string {
 	buf, err := xml.Marshal(er)
 	if err != nil {
-		log.Println("double bad error: couldn't marshal error")
-		return "unreadable error"
+		return fmt.Sprintf("unreadable error: %v", err)
 	}
 	return string(buf)
 }
@@ -284,7 +389,5 @@ func (er *Error) Error() string {
 var bindExt Extension = Extension{}
 
 func init() {
-	bindExt.StanzaTypes = make(map[xml.Name]reflect.Type)
-	bName := xml.Name{Space: NsBind, Local: "bind"}
-	bindExt.StanzaTypes[bName] = reflect.TypeOf(bindIq{})
+	RegisterPayload[bindIq](&bindExt)
 }
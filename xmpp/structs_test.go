@@ -129,3 +129,71 @@ func TestUnmarshalMessage(t *testing.T) {
 		t.Errorf("body\ngot:  %#v\nwant: %#v\n", obsBody, expBody)
 	}
 }
+
+func TestFeaturesClaim(t *testing.T) {
+	str := `<features xmlns="` + NsStream + `"><bind xmlns="` + NsBind +
+		`"/><session xmlns="` + NsSession + `"/><sm xmlns="urn:xmpp:sm:3"/>` +
+		`<ver xmlns="urn:xmpp:features:rosterver"/></features>`
+	fe := &Features{}
+	if err := xml.Unmarshal([]byte(str), fe); err != nil {
+		t.Fatal(err)
+	}
+	if fe.Bind == nil {
+		t.Error("no bind")
+	}
+	if fe.Session == nil {
+		t.Error("no session")
+	}
+	if len(fe.Other) != 2 {
+		t.Fatalf("Other: %v", fe.Other)
+	}
+	if !fe.Has("urn:xmpp:sm:3", "sm") {
+		t.Error("sm not offered")
+	}
+	if fe.Claim("urn:xmpp:sm:3", "sm") == nil {
+		t.Error("couldn't claim sm")
+	}
+	if fe.Claim("urn:xmpp:sm:3", "sm") != nil {
+		t.Error("claimed sm twice")
+	}
+	if fe.Claim("urn:xmpp:csi:0", "csi") != nil {
+		t.Error("claimed csi")
+	}
+}
+
+func TestErrorCondition(t *testing.T) {
+	str := `<error type="modify"><not-acceptable xmlns="` + NsStanzas +
+		`"/><text xmlns="` + NsStanzas + `">too long</text></error>`
+	er := &Error{}
+	if err := xml.Unmarshal([]byte(str), er); err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "not-acceptable", er.Condition())
+	assertEquals(t, "too long", er.Text.Chardata)
+	assertEquals(t, "item-not-found",
+		NewError("cancel", "item-not-found").Condition())
+
+	// An application-specific condition follows the defined one.
+	str = `<error type="wait"><bad-request xmlns="` + NsStanzas +
+		`"/><too-many xmlns="urn:example:app"/></error>`
+	er = &Error{}
+	if err := xml.Unmarshal([]byte(str), er); err != nil {
+		t.Fatal(err)
+	}
+	assertEquals(t, "bad-request", er.Condition())
+	if len(er.AppSpecific) != 1 ||
+		er.AppSpecific[0].XMLName.Local != "too-many" {
+		t.Errorf("app-specific %v", er.AppSpecific)
+	}
+	buf, err := xml.Marshal(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := &Error{}
+	if err := xml.Unmarshal(buf, back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Condition() != "bad-request" || len(back.AppSpecific) != 1 {
+		t.Errorf("round trip %s", buf)
+	}
+}
@@ -0,0 +1,170 @@
+package xmpp
+
+// This file contains support for managing presence subscriptions, RFC
+// 6121, Section 3.
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// Returned by PreApproveSubscription when the server doesn't support
+// pre-approval.
+var ErrNoPreApproval = errors.New("xmpp: server doesn't support pre-approval")
+
+// What to do with a request to subscribe to our presence.
+type SubscriptionDecision int
+
+const (
+	// Leave the request unanswered, for the application to answer
+	// later with ApproveSubscription or DenySubscription.
+	SubscriptionPending SubscriptionDecision = iota
+	// Approve the request.
+	SubscriptionAccept
+	// Deny the request.
+	SubscriptionDeny
+)
+
+// A request from a contact to subscribe to our presence.
+type SubscriptionRequest struct {
+	// The bare JID of the contact making the request.
+	From JID
+	// The subscribe presence itself.
+	Presence *Presence
+	// The contact's roster item, or nil if it isn't in our
+	// roster.
+	Item *RosterItem
+}
+
+// A SubscriptionPolicy decides what to do with requests to subscribe
+// to our presence. It's called on its own goroutine, so it may block,
+// for instance to ask a person.
+type SubscriptionPolicy func(req *SubscriptionRequest) SubscriptionDecision
+
+// WithSubscriptionPolicy has the client hand each request to subscribe
+// to our presence to policy, and send the answer it decides on. Such
+// requests then no longer appear on Client.Recv. Without a policy,
+// they're delivered there like any other presence.
+func WithSubscriptionPolicy(policy SubscriptionPolicy) Option {
+	return func(cl *Client) {
+		cl.subPolicy = policy
+	}
+}
+
+// AcceptAll is a SubscriptionPolicy which approves every request.
+func AcceptAll(req *SubscriptionRequest) SubscriptionDecision {
+	return SubscriptionAccept
+}
+
+// DenyAll is a SubscriptionPolicy which denies every request.
+func DenyAll(req *SubscriptionRequest) SubscriptionDecision {
+	return SubscriptionDeny
+}
+
+// AcceptGroups returns a SubscriptionPolicy which approves requests
+// from contacts in any of the given roster groups, and hands the rest
+// to otherwise. If otherwise is nil, the rest are left pending.
+func AcceptGroups(otherwise SubscriptionPolicy,
+	groups ...string) SubscriptionPolicy {
+
+	return func(req *SubscriptionRequest) SubscriptionDecision {
+		if req.Item != nil {
+			for _, g := range req.Item.Group {
+				for _, want := range groups {
+					if g == want {
+						return SubscriptionAccept
+					}
+				}
+			}
+		}
+		if otherwise == nil {
+			return SubscriptionPending
+		}
+		return otherwise(req)
+	}
+}
+
+// The subscription extension passes incoming subscription requests
+// to the client's policy, if it has one.
+func newSubscriptionExt(cl *Client) Extension {
+	ext := Extension{}
+	ext.RecvInterceptor = func(st Stanza) (Stanza, bool) {
+		pr, ok := st.(*Presence)
+		if !ok || pr.Type != "subscribe" || cl.subPolicy == nil {
+			return st, true
+		}
+		// Not tracked by spawn: the policy may wait on a
+		// person, and mustn't hold up shutting down.
+		go cl.decideSubscription(pr)
+		return nil, false
+	}
+	return ext
+}
+
+func (cl *Client) decideSubscription(pr *Presence) {
+	req := &SubscriptionRequest{From: pr.From.Bare(), Presence: pr}
+	if item, ok := cl.Roster.Lookup(req.From); ok {
+		req.Item = &item
+	}
+	var err error
+	switch cl.subPolicy(req) {
+	case SubscriptionAccept:
+		err = cl.ApproveSubscription(req.From)
+	case SubscriptionDeny:
+		err = cl.DenySubscription(req.From)
+	}
+	if err != nil {
+		cl.logAttrs(slog.LevelWarn, "can't answer subscription request",
+			slog.String("from", string(req.From)),
+			slog.Any("err", err))
+	}
+}
+
+// Send a subscription presence of the given type to a contact.
+func (cl *Client) sendSubscription(jid JID, typ string) error {
+	return cl.SendStanza(&Presence{Header: Header{To: jid.Bare(),
+		Id: cl.NextId(), Type: typ}})
+}
+
+// RequestSubscription asks to subscribe to a contact's presence. The
+// contact's roster item has Ask set until they answer. RFC 6121,
+// Section 3.1.
+func (cl *Client) RequestSubscription(jid JID) error {
+	return cl.sendSubscription(jid, "subscribe")
+}
+
+// ApproveSubscription approves a contact's request to subscribe to
+// our presence. RFC 6121, Section 3.1.4.
+func (cl *Client) ApproveSubscription(jid JID) error {
+	return cl.sendSubscription(jid, "subscribed")
+}
+
+// DenySubscription denies a contact's request to subscribe to our
+// presence. RFC 6121, Section 3.1.4.
+func (cl *Client) DenySubscription(jid JID) error {
+	return cl.sendSubscription(jid, "unsubscribed")
+}
+
+// PreApproveSubscription approves a contact's request to subscribe to
+// our presence before it's made, so the server can approve it for us.
+// The contact's roster item has Approved set until then. If the
+// server doesn't support pre-approval, it returns ErrNoPreApproval.
+// RFC 6121, Section 3.4.
+func (cl *Client) PreApproveSubscription(jid JID) error {
+	if cl.Features == nil || !cl.Features.Has(NsPreApproval, "sub") {
+		return ErrNoPreApproval
+	}
+	return cl.ApproveSubscription(jid)
+}
+
+// CancelSubscription cancels a contact's subscription to our
+// presence, or a pre-approval we gave them. RFC 6121, Section 3.2.
+func (cl *Client) CancelSubscription(jid JID) error {
+	return cl.sendSubscription(jid, "unsubscribed")
+}
+
+// Unsubscribe cancels our subscription to a contact's presence. RFC
+// 6121, Section 3.3.
+func (cl *Client) Unsubscribe(jid JID) error {
+	return cl.sendSubscription(jid, "unsubscribe")
+}
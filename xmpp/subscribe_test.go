@@ -0,0 +1,90 @@
+package xmpp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSubscriptionPolicy(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.handle = func(fs *fakeServer, e *rawElem) bool {
+		if e.XMLName.Local != "iq" || e.attr("type") != "get" ||
+			!strings.Contains(e.Inner, NsRoster) {
+			return false
+		}
+		fs.write(fmt.Sprintf(`<iq type="result" id="%s">`+
+			`<query xmlns="%s"><item jid="a@b.c" `+
+			`subscription="none" ask="subscribe" approved="true">`+
+			`<group>Friends</group></item></query></iq>`,
+			e.attr("id"), NsRoster))
+		return true
+	}
+	asked := make(chan *SubscriptionRequest, 1)
+	cl := fs.client(WithSubscriptionPolicy(AcceptGroups(
+		func(req *SubscriptionRequest) SubscriptionDecision {
+			asked <- req
+			return SubscriptionDeny
+		}, "Friends")))
+	defer cl.Close()
+	drain(cl)
+	fs.next()
+
+	item, _ := cl.Roster.Lookup("a@b.c")
+	if item.Ask != "subscribe" || !item.Approved {
+		t.Errorf("item %+v", item)
+	}
+
+	fs.write(`<presence from="a@b.c/r" type="subscribe"/>`)
+	e := fs.next()
+	if e.attr("type") != "subscribed" || e.attr("to") != "a@b.c" {
+		t.Errorf("friend: %v", e.Attrs)
+	}
+	fs.write(`<presence from="z@b.c/r" type="subscribe"/>`)
+	e = fs.next()
+	if e.attr("type") != "unsubscribed" || e.attr("to") != "z@b.c" {
+		t.Errorf("stranger: %v", e.Attrs)
+	}
+	req := <-asked
+	if req.From != "z@b.c" || req.Item != nil || req.Presence == nil {
+		t.Errorf("asked %+v", req)
+	}
+
+	if err := cl.PreApproveSubscription("p@b.c"); err != ErrNoPreApproval {
+		t.Errorf("pre-approve: %v", err)
+	}
+	cl.RequestSubscription("q@b.c/r")
+	e = fs.next()
+	if e.attr("type") != "subscribe" || e.attr("to") != "q@b.c" {
+		t.Errorf("request: %v", e.Attrs)
+	}
+}
+
+func TestSubscriptionPassThrough(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.features = `<sub xmlns="` + NsPreApproval + `"/>`
+	cl := fs.client()
+	defer cl.Close()
+	fs.next()
+
+	fs.write(`<presence from="a@b.c/r" type="subscribe"/>`)
+	for st := range cl.Recv {
+		if pr, ok := st.(*Presence); ok {
+			if pr.Type != "subscribe" || pr.From != "a@b.c/r" {
+				t.Errorf("presence %+v", pr)
+			}
+			break
+		}
+	}
+	drain(cl)
+
+	if err := cl.PreApproveSubscription("p@b.c"); err != nil {
+		t.Fatal(err)
+	}
+	e := fs.next()
+	if e.attr("type") != "subscribed" || e.attr("to") != "p@b.c" {
+		t.Errorf("pre-approve: %v", e.Attrs)
+	}
+}
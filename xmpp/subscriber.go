@@ -0,0 +1,158 @@
+package xmpp
+
+// This file contains the plumbing which delivers stanzas and events,
+// such as roster changes, to the application.
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracks the goroutines which wait for the application to read what
+// they deliver, so Close can wait for them, or tell them to give up.
+type deliveries struct {
+	// Closed when Close stops waiting for the application.
+	quit    chan struct{}
+	lock    sync.Mutex
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+func newDeliveries() *deliveries {
+	return &deliveries{quit: make(chan struct{})}
+}
+
+// Run a goroutine which delivers to the application. It must return
+// promptly once quit is closed.
+func (d *deliveries) spawn(f func()) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.stopped {
+		// Close has stopped counting, but it won't be long
+		// before quit is closed.
+		go f()
+		return
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		f()
+	}()
+}
+
+// Wait for the delivering goroutines to exit, which they do once
+// the application has read everything. When timeout fires, whatever
+// it hasn't read is discarded.
+func (d *deliveries) stop(timeout <-chan time.Time) {
+	d.lock.Lock()
+	d.stopped = true
+	d.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-timeout:
+	}
+	close(d.quit)
+	<-done
+}
+
+// Pass stanzas on to the application until in is closed, then close
+// out.
+func (d *deliveries) relayStanzas(in <-chan Stanza, out chan<- Stanza) {
+	defer close(out)
+	for st := range in {
+		select {
+		case out <- st:
+		case <-d.quit:
+		}
+	}
+}
+
+// A subscriber to events of type T. Managers hand events to relay,
+// which queues them for as long as the subscriber takes to read them,
+// so managers never wait on the application.
+type subscriber[T any] struct {
+	in   chan []T
+	out  chan T
+	quit chan struct{}
+	once sync.Once
+	// Closed when the client stops delivering.
+	gone <-chan struct{}
+}
+
+func newSubscriber[T any](d *deliveries) *subscriber[T] {
+	s := &subscriber[T]{in: make(chan []T), out: make(chan T),
+		quit: make(chan struct{}), gone: d.quit}
+	d.spawn(s.relay)
+	return s
+}
+
+func (s *subscriber[T]) relay() {
+	defer close(s.out)
+	in := s.in
+	var queue []T
+	for in != nil || len(queue) > 0 {
+		var out chan<- T
+		var next T
+		if len(queue) > 0 {
+			out, next = s.out, queue[0]
+		}
+		select {
+		case evs, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, evs...)
+		case out <- next:
+			queue = queue[1:]
+		case <-s.quit:
+			return
+		case <-s.gone:
+			return
+		}
+	}
+}
+
+// Unsubscribe. The subscriber's channel is closed, and events still
+// queued are discarded.
+func (s *subscriber[T]) cancel() {
+	s.once.Do(func() { close(s.quit) })
+}
+
+// Called by the manager when it stops. Events already queued are
+// still delivered before the channel is closed, unless the client
+// stops delivering first.
+func (s *subscriber[T]) close() {
+	close(s.in)
+}
+
+// Hand events to a subscriber. Returns false if it has gone away.
+func (s *subscriber[T]) send(evs []T) bool {
+	select {
+	case s.in <- evs:
+		return true
+	case <-s.quit:
+		return false
+	case <-s.gone:
+		return false
+	}
+}
+
+// Hand events to each subscriber, and return those still listening.
+func publish[T any](subs []*subscriber[T], evs []T) []*subscriber[T] {
+	if len(evs) == 0 {
+		return subs
+	}
+	live := subs[:0]
+	for _, s := range subs {
+		if s.send(evs) {
+			live = append(live, s)
+		}
+	}
+	return live
+}
@@ -0,0 +1,160 @@
+package xmpp
+
+// This file contains support for tracing a session: each element
+// exchanged with the server is reported, as XML, to a hook which the
+// application can supply per client.
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// The direction of a traced element.
+type TraceDir int
+
+const (
+	TraceSend TraceDir = iota
+	TraceRecv
+)
+
+func (d TraceDir) String() string {
+	if d == TraceSend {
+		return "send"
+	}
+	return "recv"
+}
+
+// A TraceEvent describes one top-level element sent to or received
+// from the server. The stream header and closing tag are reported as
+// elements of their own.
+type TraceEvent struct {
+	Time time.Time
+	Dir  TraceDir
+	// The element's XML, with surrounding whitespace removed.
+	Data []byte
+}
+
+// A Tracer is called for each element the client sends or receives.
+// It's called from the client's internal goroutines, possibly
+// concurrently, and shouldn't block.
+type Tracer func(ev TraceEvent)
+
+// If enabled when a client is created without WithTracer, everything
+// it sends and receives is printed with the log package.
+//
+// Deprecated: Use WithTracer, and WithLogger for diagnostics.
+var Debug = false
+
+// What Debug used to print.
+func debugTracer(ev TraceEvent) {
+	log.Printf("%s: %s", ev.Dir, ev.Data)
+}
+
+// WithTracer has the client report everything it exchanges with the
+// server to t. The contents of SASL elements, which include the
+// user's credentials, are redacted unless WithTraceAuth is also
+// given.
+func WithTracer(t Tracer) Option {
+	return func(cl *Client) {
+		cl.tracer = t
+	}
+}
+
+// WithTraceAuth disables the redaction of SASL elements in traces.
+func WithTraceAuth() Option {
+	return func(cl *Client) {
+		cl.traceAuth = true
+	}
+}
+
+// TraceWriter returns a Tracer which writes a transcript of the
+// session to w, one element per line, each preceded by its time and
+// direction.
+func TraceWriter(w io.Writer) Tracer {
+	var lock sync.Mutex
+	return func(ev TraceEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprintf(w, "%s %s %s\n",
+			ev.Time.Format(time.RFC3339Nano), ev.Dir, ev.Data)
+	}
+}
+
+// Report an element to the tracer, if there is one.
+func (cl *Client) trace(dir TraceDir, data []byte) {
+	if cl.tracer == nil {
+		return
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return
+	}
+	if !cl.traceAuth {
+		data = redactAuth(data)
+	}
+	cl.tracer(TraceEvent{Time: time.Now(), Dir: dir,
+		Data: bytes.Clone(data)})
+}
+
+// The SASL elements whose contents may reveal credentials.
+var redacted = map[xml.Name]bool{
+	{Space: NsSASL, Local: "auth"}:      true,
+	{Space: NsSASL, Local: "response"}:  true,
+	{Space: NsSASL, Local: "challenge"}: true,
+	{Space: NsSASL, Local: "success"}:   true,
+}
+
+// If data is a SASL element with contents, replace them.
+func redactAuth(data []byte) []byte {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	t, err := dec.Token()
+	if err != nil {
+		return data
+	}
+	se, ok := t.(xml.StartElement)
+	if !ok || !redacted[se.Name] {
+		return data
+	}
+	start := int(dec.InputOffset())
+	end := bytes.LastIndex(data, []byte("</"))
+	if end < start {
+		// An empty element.
+		return data
+	}
+	out := make([]byte, 0, start+len(data)-end+10)
+	out = append(out, data[:start]...)
+	out = append(out, "(redacted)"...)
+	return append(out, data[end:]...)
+}
+
+// Records what's read through it, so the raw XML of each element can
+// be recovered once the decoder has consumed it.
+type traceReader struct {
+	r   io.Reader
+	buf []byte
+	// The input offset of buf[0].
+	base int64
+}
+
+func (t *traceReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.buf = append(t.buf, p[:n]...)
+	return n, err
+}
+
+// Return the input up to off which hasn't been returned already.
+func (t *traceReader) take(off int64) []byte {
+	n := off - t.base
+	if n <= 0 {
+		return nil
+	}
+	data := t.buf[:n]
+	t.buf = t.buf[n:]
+	t.base = off
+	return data
+}
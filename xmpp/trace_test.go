@@ -0,0 +1,131 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedactAuth(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{`<auth xmlns="` + NsSASL + `" mechanism="PLAIN">AGEAYg==</auth>`,
+			`<auth xmlns="` + NsSASL + `" mechanism="PLAIN">(redacted)</auth>`},
+		{`<success xmlns="` + NsSASL + `"/>`,
+			`<success xmlns="` + NsSASL + `"/>`},
+		{`<success xmlns="` + NsSASL + `"></success>`,
+			`<success xmlns="` + NsSASL + `">(redacted)</success>`},
+		{`<message><body>hi</body></message>`,
+			`<message><body>hi</body></message>`},
+		{`</stream:stream>`, `</stream:stream>`},
+	}
+	for _, test := range tests {
+		assertEquals(t, test.out, string(redactAuth([]byte(test.in))))
+	}
+}
+
+func TestTraceRecv(t *testing.T) {
+	var evs []TraceEvent
+	cl := &Client{tracer: func(ev TraceEvent) {
+		evs = append(evs, ev)
+	}}
+	r := strings.NewReader(`<?xml version='1.0'?><stream:stream ` +
+		`xmlns="` + NsClient + `" xmlns:stream="` + NsStream + `"> ` +
+		`<message to="a@b.c"><body>hi</body></message>` + "\n" +
+		`<challenge xmlns="` + NsSASL + `">c2VjcmV0</challenge>` +
+		`</stream:stream>`)
+	ch := make(chan interface{})
+	go cl.recvXml(r, ch, make(map[xml.Name]reflect.Type))
+	for range ch {
+	}
+	want := []string{
+		`<?xml version='1.0'?><stream:stream xmlns="` + NsClient +
+			`" xmlns:stream="` + NsStream + `">`,
+		`<message to="a@b.c"><body>hi</body></message>`,
+		`<challenge xmlns="` + NsSASL + `">(redacted)</challenge>`,
+		`</stream:stream>`,
+	}
+	if len(evs) != len(want) {
+		t.Fatalf("got %d events", len(evs))
+	}
+	for i, ev := range evs {
+		assertEquals(t, want[i], string(ev.Data))
+		if ev.Dir != TraceRecv {
+			t.Errorf("%d: direction %v", i, ev.Dir)
+		}
+	}
+}
+
+func TestTraceSession(t *testing.T) {
+	var lock sync.Mutex
+	var buf bytes.Buffer
+	fs := newFakeServer(t)
+	defer fs.close()
+	w := TraceWriter(lockedWriter{&lock, &buf})
+	cl := fs.client(WithTracer(w))
+	drain(cl)
+	fs.next()
+	cl.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	out := buf.String()
+	cred := base64.StdEncoding.EncodeToString(
+		[]byte("\x00user\x00secret"))
+	if strings.Contains(out, cred) {
+		t.Error("credentials in trace")
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	first := strings.SplitN(lines[0], " ", 3)
+	if _, err := time.Parse(time.RFC3339Nano, first[0]); err != nil {
+		t.Error(err)
+	}
+	assertEquals(t, "send", first[1])
+	if !strings.HasPrefix(first[2], "<stream:stream") {
+		t.Errorf("first element %s", first[2])
+	}
+	last := lines[len(lines)-1]
+	if !strings.HasSuffix(last, "recv </stream:stream>") {
+		t.Errorf("last element %s", last)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	var lock sync.Mutex
+	var buf bytes.Buffer
+	log.SetOutput(lockedWriter{&lock, &buf})
+	defer log.SetOutput(os.Stderr)
+	Debug = true
+	defer func() { Debug = false }()
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client()
+	drain(cl)
+	fs.next()
+	cl.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	out := buf.String()
+	if !strings.Contains(out, "send: <stream:stream") ||
+		!strings.Contains(out, "recv: </stream:stream>") {
+		t.Errorf("log output %s", out)
+	}
+}
+
+type lockedWriter struct {
+	lock *sync.Mutex
+	buf  *bytes.Buffer
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.Write(p)
+}
@@ -9,11 +9,15 @@ package xmpp
 import (
 	"crypto/tls"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -21,27 +25,56 @@ const (
 	XMPPVersion = "1.0"
 
 	// Various XML namespaces.
-	NsClient  = "jabber:client"
-	NsStreams = "urn:ietf:params:xml:ns:xmpp-streams"
-	NsStream  = "http://etherx.jabber.org/streams"
-	NsTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
-	NsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
-	NsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
-	NsSession = "urn:ietf:params:xml:ns:xmpp-session"
-	NsRoster  = "jabber:iq:roster"
+	NsClient      = "jabber:client"
+	NsStreams     = "urn:ietf:params:xml:ns:xmpp-streams"
+	NsStanzas     = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	NsStream      = "http://etherx.jabber.org/streams"
+	NsTLS         = "urn:ietf:params:xml:ns:xmpp-tls"
+	NsSASL        = "urn:ietf:params:xml:ns:xmpp-sasl"
+	NsBind        = "urn:ietf:params:xml:ns:xmpp-bind"
+	NsSession     = "urn:ietf:params:xml:ns:xmpp-session"
+	NsRoster      = "jabber:iq:roster"
+	NsRosterVer   = "urn:xmpp:features:rosterver"
+	NsPreApproval = "urn:xmpp:features:pre-approval"
+	NsPing        = "urn:xmpp:ping"
+	NsMUC         = "http://jabber.org/protocol/muc"
+	NsMUCUser     = "http://jabber.org/protocol/muc#user"
+	NsConference  = "jabber:x:conference"
+
+	// How long Close waits for the server to end its stream, by
+	// default.
+	DefaultCloseTimeout = 5 * time.Second
+
+	// How long callbacks wait for a reply, by default.
+	DefaultCallbackTimeout = time.Minute
 
 	// DNS SRV names
 	serverSrv = "xmpp-server"
 	clientSrv = "xmpp-client"
 )
 
+// Returned when trying to send after the client's stream has ended.
+var ErrClosed = errors.New("xmpp: client closed")
+
+// Returned when an iq isn't answered within the callback timeout.
+var ErrNoReply = errors.New("xmpp: no reply")
+
 // A filter can modify the XMPP traffic to or from the remote
 // server. It's part of an Extension. The filter function will be
 // called in a new goroutine, so it doesn't need to return. The filter
 // should close its output when its input is closed.
 type Filter func(in <-chan Stanza, out chan<- Stanza)
 
-// Extensions can add stanza filters and/or new XML element types.
+// An Interceptor is a lighter-weight alternative to a Filter. It's
+// called synchronously for each stanza, and returns the stanza to
+// pass on, which may be a modified or different one, and whether to
+// pass anything on at all. Interceptors are run inline on the
+// goroutine moving stanzas through the filter stack, so they must not
+// block. They may add and remove filters, including themselves.
+type Interceptor func(Stanza) (Stanza, bool)
+
+// Extensions can add stanza filters and/or new XML element types,
+// and can take part in negotiating the stream.
 type Extension struct {
 	// Maps from an XML name to a structure which holds stanza
 	// contents with that name.
@@ -52,8 +85,37 @@ type Extension struct {
 	// intercepts messages going the other direction.
 	RecvFilter Filter
 	SendFilter Filter
+	// If non-nil, will be installed alongside the filters.
+	RecvInterceptor Interceptor
+	SendInterceptor Interceptor
+	// If non-nil, called when the server offers stream features
+	// after authentication, before resource binding. The hook may
+	// claim feature elements with Features.Claim and negotiate them
+	// using Client.SendRaw. If it returns true, the library won't
+	// bind a resource from these features; the extension is then
+	// responsible for restarting the stream with
+	// Client.RestartStream, so the server offers new ones.
+	OnFeatures func(cl *Client, fe *Features) bool
+	// If non-nil, called once resource binding has completed, with
+	// the features the server offered. This is the place to enable
+	// features which require a bound resource.
+	OnBound func(cl *Client, fe *Features)
+	// If non-nil, called once the session is running and normal
+	// traffic can flow.
+	OnRunning func(cl *Client)
+	// If non-nil, called once when the client shuts down.
+	OnShutdown func(cl *Client)
+	// If non-nil, called for top-level elements received from the
+	// server which the library doesn't understand itself. Returns
+	// true if the element was handled.
+	OnElement func(cl *Client, el *Generic) bool
 }
 
+// An Option configures optional behavior of a Client. Options are
+// applied by NewClient and NewClientFromHost before the connection
+// is negotiated.
+type Option func(*Client)
+
 // The client in a client-server XMPP connection.
 type Client struct {
 	// This client's full JID, including resource
@@ -61,36 +123,109 @@ type Client struct {
 	password     string
 	saslExpected string
 	authDone     bool
-	handlers     chan *callback
+	// Callbacks waiting to be handed to recvStream. Once it has
+	// stopped, handlersQuit is closed, then handlersClosed is set,
+	// and new callbacks are answered with nil straight away.
+	handlers       chan *callback
+	handlersLock   sync.RWMutex
+	handlersClosed bool
+	handlersQuit   chan struct{}
 	// Incoming XMPP stanzas from the remote will be published on
 	// this channel. Information which is used by this library to
 	// set up the XMPP stream will not appear here.
 	Recv <-chan Stanza
-	// Outgoing XMPP stanzas to the server should be sent to this
+	// Outgoing XMPP stanzas to the server may be sent to this
 	// channel. The application should not close this channel;
-	// rather, call Close().
-	Send    chan<- Stanza
-	sendRaw chan<- interface{}
-	statmgr *statmgr
+	// rather, call Close(). Stanzas sent to it once Close has been
+	// called are discarded. SendStanza is safer, since it reports
+	// that.
+	Send chan<- Stanza
+	send chan Stanza
+	// The send queue. See SendStanza and WithSendQueue.
+	queue       chan Stanza
+	queueSize   int
+	queuePolicy QueuePolicy
+	// sendQuit is closed when Close is called, then sendClosed is
+	// set, then sendFlush is closed.
+	sendLock            sync.RWMutex
+	sendClosed          bool
+	sendQuit, sendFlush chan struct{}
+	// Elements to be sent directly to the server. Protected by
+	// rawLock, since it's closed when our stream ends.
+	sendRaw   chan<- interface{}
+	rawLock   sync.Mutex
+	rawClosed bool
+	statmgr   *statmgr
 	// The client's roster is also known as the buddy list. It's
 	// the set of contacts which are known to this JID, or which
 	// this JID is known to.
 	Roster Roster
+	// The latest presence of the entities we hear from.
+	Presences PresenceTracker
+	// The multi-user chat rooms we're in.
+	MUC MUC
 	// Features advertised by the remote.
-	Features                     *Features
-	sendFilterAdd, recvFilterAdd chan Filter
-	tlsConfig                    *tls.Config
-	layer1                       *layer1
-	error                        chan error
-	shutdownOnce                 sync.Once
+	Features *Features
+	// The languages preferred by this client, most preferred
+	// first. See WithLanguages.
+	Languages []string
+	// The default language of the remote's stream, if it
+	// announced one.
+	streamLang string
+	// Types of the nested elements understood by our extensions.
+	payloads map[xml.Name]reflect.Type
+	// All our extensions, including the mandatory ones.
+	exts []Extension
+	// How long Close waits for the server. See WithCloseTimeout.
+	closeTimeout time.Duration
+	// See WithTracer and WithTraceAuth.
+	tracer    Tracer
+	traceAuth bool
+	// See WithLogger.
+	log *slog.Logger
+	// log, tagged with our JID. It's replaced once the server has
+	// bound our resource.
+	jidLog atomic.Pointer[slog.Logger]
+	// See WithMetrics.
+	metrics Metrics
+	// See WithCallbackTimeout.
+	callbackTimeout time.Duration
+	// See WithRosterStore.
+	rosterStore RosterStore
+	// See WithIdGenerator.
+	ids IdGenerator
+	// See WithSubscriptionPolicy.
+	subPolicy SubscriptionPolicy
+	// See WithInvitationPolicy.
+	invitePolicy InvitationPolicy
+	inviteNick   string
+	// See WithMUCSelfPing.
+	mucPingInterval, mucPingTimeout time.Duration
+	// See WithKeepalive and WithWhitespaceKeepalive.
+	keepInterval, keepTimeout time.Duration
+	keepWhitespace            bool
+	// Tracks the goroutines which carry the stream. done is closed
+	// when they've all exited.
+	wg   sync.WaitGroup
+	done chan struct{}
+	// The goroutines which deliver stanzas and events to the app.
+	deliveries *deliveries
+	// Closed once Close has finished.
+	closed                   chan struct{}
+	sendFilters, recvFilters *filterChain
+	tlsConfig                *tls.Config
+	layer1                   *layer1
+	error                    chan error
+	shutdownOnce             sync.Once
 }
 
 // Creates an XMPP client identified by the given JID, authenticating
 // with the provided password and TLS config. Zero or more extensions
 // may be specified. The initial presence will be broadcast. If status
 // is non-nil, connection progress information will be sent on it.
+// Any options are applied to the client before connecting.
 func NewClient(jid *JID, password string, tlsconf *tls.Config, exts []Extension,
-	pr Presence, status chan<- Status) (*Client, error) {
+	pr Presence, status chan<- Status, opts ...Option) (*Client, error) {
 
 	// Resolve the domain in the JID.
 	domain := jid.Domain()
@@ -121,14 +256,14 @@ func NewClient(jid *JID, password string, tlsconf *tls.Config, exts []Extension,
 		return nil, err
 	}
 
-	return newClient(tcp, jid, password, tlsconf, exts, pr, status)
+	return newClient(tcp, jid, password, tlsconf, exts, pr, status, opts)
 }
 
 // Connect to the specified host and port. This is otherwise identical
 // to NewClient.
 func NewClientFromHost(jid *JID, password string, tlsconf *tls.Config,
 	exts []Extension, pr Presence, status chan<- Status, host string,
-	port int) (*Client, error) {
+	port int, opts ...Option) (*Client, error) {
 
 	addrStr := fmt.Sprintf("%s:%d", host, port)
 	addr, err := net.ResolveTCPAddr("tcp", addrStr)
@@ -140,27 +275,50 @@ func NewClientFromHost(jid *JID, password string, tlsconf *tls.Config,
 		return nil, err
 	}
 
-	return newClient(tcp, jid, password, tlsconf, exts, pr, status)
+	return newClient(tcp, jid, password, tlsconf, exts, pr, status, opts)
 }
 
 func newClient(tcp *net.TCPConn, jid *JID, password string, tlsconf *tls.Config,
-	exts []Extension, pr Presence, status chan<- Status) (*Client, error) {
+	exts []Extension, pr Presence, status chan<- Status,
+	opts []Option) (*Client, error) {
 
 	// Include the mandatory extensions.
 	roster := newRosterExt()
 	exts = append(exts, roster.Extension)
+	presences := newPresenceExt()
+	exts = append(exts, presences.Extension)
+	muc := newMUCExt()
+	exts = append(exts, muc.Extension)
 	exts = append(exts, bindExt)
 
 	cl := new(Client)
+	roster.cl = cl
+	presences.cl = cl
 	cl.Roster = *roster
+	cl.Presences = *presences
+	muc.cl = cl
+	cl.MUC = *muc
 	cl.password = password
 	cl.Jid = *jid
 	cl.handlers = make(chan *callback, 100)
+	cl.handlersQuit = make(chan struct{})
 	cl.tlsConfig = tlsconf
-	cl.sendFilterAdd = make(chan Filter)
-	cl.recvFilterAdd = make(chan Filter)
-	cl.statmgr = newStatmgr(status)
 	cl.error = make(chan error, 1)
+	cl.closeTimeout = DefaultCloseTimeout
+	cl.queueSize = DefaultQueueSize
+	cl.done = make(chan struct{})
+	cl.deliveries = newDeliveries()
+	cl.closed = make(chan struct{})
+	for _, opt := range opts {
+		opt(cl)
+	}
+	if Debug && cl.tracer == nil {
+		cl.tracer = debugTracer
+	}
+	cl.statmgr = newStatmgr(status, cl.metrics)
+	cl.tagLogger()
+	exts = append(exts, newPingExt(cl))
+	exts = append(exts, newSubscriptionExt(cl))
 
 	extStanza := make(map[xml.Name]reflect.Type)
 	for _, ext := range exts {
@@ -172,6 +330,8 @@ func newClient(tcp *net.TCPConn, jid *JID, password string, tlsconf *tls.Config,
 			extStanza[k] = v
 		}
 	}
+	cl.payloads = extStanza
+	cl.exts = exts
 
 	// The thing that called this made a TCP connection, so now we
 	// can signal that it's connected.
@@ -185,84 +345,220 @@ func newClient(tcp *net.TCPConn, jid *JID, password string, tlsconf *tls.Config,
 
 	// Start the reader and writer that convert to and from XML.
 	recvXmlCh := make(chan interface{})
-	go cl.recvXml(recvReader, recvXmlCh, extStanza)
+	cl.spawn(func() { cl.recvXml(recvReader, recvXmlCh, extStanza) })
 	sendXmlCh := make(chan interface{})
 	cl.sendRaw = sendXmlCh
-	go cl.sendXml(sendWriter, sendXmlCh)
+	cl.spawn(func() { cl.sendXml(sendWriter, sendXmlCh) })
 
 	// Start the reader and writer that convert between XML and
 	// XMPP stanzas.
 	recvRawXmpp := make(chan Stanza)
-	go cl.recvStream(recvXmlCh, recvRawXmpp, cl.statmgr.newListener())
+	recvStatus := cl.statmgr.newListener()
+	cl.spawn(func() { cl.recvStream(recvXmlCh, recvRawXmpp, recvStatus) })
 	sendRawXmpp := make(chan Stanza)
-	go sendStream(sendXmlCh, sendRawXmpp, cl.statmgr.newListener())
+	sendStatus := cl.statmgr.newListener()
+	cl.spawn(func() { cl.sendStream(sendRawXmpp, sendStatus) })
+	go func() {
+		cl.wg.Wait()
+		close(cl.done)
+	}()
 
 	// Start the managers for the filters that can modify what the
 	// app sees or sends.
 	recvFiltXmpp := make(chan Stanza)
-	cl.Recv = recvFiltXmpp
-	go filterMgr(cl.recvFilterAdd, recvRawXmpp, recvFiltXmpp)
+	cl.recvFilters = newFilterChain(recvRawXmpp, recvFiltXmpp)
+	recv := make(chan Stanza)
+	cl.Recv = recv
+	cl.deliveries.spawn(func() {
+		cl.deliveries.relayStanzas(recvFiltXmpp, recv)
+	})
 	sendFiltXmpp := make(chan Stanza)
-	cl.Send = sendFiltXmpp
-	go filterMgr(cl.sendFilterAdd, sendFiltXmpp, sendRawXmpp)
+	cl.sendFilters = newFilterChain(sendFiltXmpp, sendRawXmpp)
+
+	// Start the queue of stanzas the app sends.
+	cl.send = make(chan Stanza)
+	cl.Send = cl.send
+	cl.queue = make(chan Stanza, max(cl.queueSize, 0))
+	cl.sendQuit = make(chan struct{})
+	cl.sendFlush = make(chan struct{})
+	cl.spawn(func() { cl.sendQueue(sendFiltXmpp) })
 	// Set up the initial filters.
 	for _, ext := range exts {
 		cl.AddRecvFilter(ext.RecvFilter)
 		cl.AddSendFilter(ext.SendFilter)
+		cl.AddRecvInterceptor(ext.RecvInterceptor)
+		cl.AddSendInterceptor(ext.SendInterceptor)
 	}
 
 	// Initial handshake.
-	hsOut := &stream{To: jid.Domain(), Version: XMPPVersion}
-	cl.sendRaw <- hsOut
+	cl.SendRaw(cl.streamHeader())
 
 	// Wait until resource binding is complete.
 	if err := cl.statmgr.awaitStatus(StatusBound); err != nil {
-		return nil, cl.getError(err)
+		return nil, cl.abort(err)
 	}
 
 	// Forget about the password, for paranoia's sake.
 	cl.password = ""
 
 	// Initialize the session.
-	id := NextId()
+	id := cl.NextId()
 	iq := &Iq{Header: Header{To: JID(cl.Jid.Domain()), Id: id, Type: "set",
 		Nested: []interface{}{Generic{XMLName: xml.Name{Space: NsSession, Local: "session"}}}}}
 	ch := make(chan error)
 	f := func(st Stanza) {
 		iq, ok := st.(*Iq)
 		if !ok {
-			ch <- fmt.Errorf("bad session start reply: %#v", st)
+			ch <- fmt.Errorf("no reply to session start")
+			return
 		}
 		if iq.Type == "error" {
 			ch <- fmt.Errorf("Can't start session: %v", iq.Error)
+			return
 		}
 		ch <- nil
 	}
-	cl.SetCallback(id, f)
-	cl.sendRaw <- iq
+	cl.SetIqCallback(iq, f)
+	cl.SendRaw(iq)
 	// Now wait until the callback is called.
 	if err := <-ch; err != nil {
-		return nil, cl.getError(err)
+		return nil, cl.abort(err)
 	}
 
 	// This allows the client to receive stanzas.
 	cl.setStatus(StatusRunning)
+	for _, ext := range cl.exts {
+		if ext.OnRunning != nil {
+			ext.OnRunning(cl)
+		}
+	}
 
 	// Request the roster.
-	cl.Roster.update()
+	cl.Roster.update(cl.NextId())
 
 	// Send the initial presence.
-	cl.Send <- &pr
+	cl.SendStanza(&pr)
 
 	return cl, cl.getError(nil)
 }
 
+// Build the stream header we send at the start of the stream and
+// after each restart.
+func (cl *Client) streamHeader() *stream {
+	st := &stream{To: cl.Jid.Domain(), Version: XMPPVersion}
+	if len(cl.Languages) > 0 {
+		st.Lang = cl.Languages[0]
+	}
+	return st
+}
+
+// WithCloseTimeout sets how long Close waits for the server to end
+// its stream before dropping the connection.
+func WithCloseTimeout(d time.Duration) Option {
+	return func(cl *Client) {
+		cl.closeTimeout = d
+	}
+}
+
+// SendRaw sends an element directly to the server, bypassing the
+// filters and regardless of the connection status. It's intended
+// for extensions which take part in stream negotiation. Returns
+// ErrClosed if our stream has already ended.
+func (cl *Client) SendRaw(x interface{}) error {
+	cl.rawLock.Lock()
+	defer cl.rawLock.Unlock()
+	if cl.rawClosed {
+		return ErrClosed
+	}
+	cl.sendRaw <- x
+	return nil
+}
+
+// End our side of the stream: nothing more can be sent.
+func (cl *Client) closeRaw() {
+	cl.rawLock.Lock()
+	defer cl.rawLock.Unlock()
+	if !cl.rawClosed {
+		cl.rawClosed = true
+		close(cl.sendRaw)
+	}
+}
+
+// RestartStream sends a new stream header, as required after some
+// negotiated features take effect. The server will respond with a new
+// set of features.
+func (cl *Client) RestartStream() {
+	cl.Features = nil
+	cl.SendRaw(cl.streamHeader())
+}
+
+// Close ends the session cleanly, as described in RFC 6120, Section
+// 4.4. Stanzas which have already been queued are flushed, followed by
+// unavailable presence and our closing stream tag. Close then waits
+// for the server to close its stream, or for the close timeout to
+// expire. Anything the application hasn't read from Recv or from a
+// Subscribe channel by then is discarded, and Close returns once the
+// client's internal goroutines have exited. Invitation and
+// subscription policies run on goroutines of their own, which Close
+// doesn't wait for. It's safe to call Close more than once, but not
+// from a filter, interceptor or callback run by the client: the stream
+// can't end while one of those is waiting, so Close would never
+// return.
 func (cl *Client) Close() {
-	// Shuts down the receivers:
-	cl.setStatus(StatusShutdown)
+	cl.shutdownOnce.Do(func() {
+		for _, ext := range cl.exts {
+			if ext.OnShutdown != nil {
+				ext.OnShutdown(cl)
+			}
+		}
+		deadline := time.Now().Add(cl.closeTimeout)
+		timeout := time.After(cl.closeTimeout)
+		if cl.status() == StatusRunning {
+			pr := &Presence{Header: Header{Type: "unavailable"}}
+			cl.enqueue(pr, QueueBlock, timeout)
+		} else {
+			// There's no stream to end.
+			cl.setStatus(StatusShutdown)
+		}
+		// Once the filters have delivered everything, this
+		// ends our stream.
+		cl.closeQueue()
+		select {
+		case <-cl.done:
+		case <-timeout:
+			cl.setStatus(StatusShutdown)
+		}
+		<-cl.done
+		// The stream has gone, so nothing more is coming. Give
+		// the app until the timeout to read what's left, and
+		// wait for everything else to wind down.
+		cl.deliveries.stop(time.After(time.Until(deadline)))
+		for _, done := range []<-chan struct{}{
+			cl.recvFilters.done, cl.sendFilters.done,
+			cl.Roster.done, cl.Presences.done, cl.MUC.done,
+			cl.statmgr.done} {
+			<-done
+		}
+		close(cl.closed)
+	})
+	<-cl.closed
+}
+
+// Run one of the client's internal goroutines, which Close will wait
+// for.
+func (cl *Client) spawn(f func()) {
+	cl.wg.Add(1)
+	go func() {
+		defer cl.wg.Done()
+		f()
+	}()
+}
 
-	// Shuts down the senders:
-	cl.shutdownOnce.Do(func() { close(cl.Send) })
+// Give up on a half-built client.
+func (cl *Client) abort(err error) error {
+	cl.setError(err)
+	cl.Close()
+	return cl.getError(err)
 }
 
 // If there's a buffered error in the channel, return it. Otherwise,
@@ -282,8 +578,8 @@ func (cl *Client) getError(err1 error) error {
 // there's already an error in the channel, discard the newer one in
 // favor of the older.
 func (cl *Client) setError(err error) {
-	defer cl.Close()
 	defer cl.setStatus(StatusError)
+	cl.logAttrs(slog.LevelError, "session failed", slog.Any("err", err))
 
 	if len(cl.error) > 0 {
 		return
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestReadError(t *testing.T) {
@@ -99,3 +100,96 @@ func TestWriteStream(t *testing.T) {
 		` from="bar.com" id="42" xml:lang="en" version="1.0">`
 	assertEquals(t, exp, str)
 }
+
+func TestWriteStreamEnd(t *testing.T) {
+	str := testWrite(&streamEnd{})
+	assertEquals(t, "</stream:stream>", str)
+}
+
+func TestClose(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client()
+	drain(cl)
+	// The initial presence.
+	fs.next()
+
+	cl.Close()
+	e := fs.next()
+	if e.XMLName.Local != "presence" ||
+		e.attr("type") != "unavailable" {
+		t.Errorf("got %s %s", e.XMLName.Local, e.attr("type"))
+	}
+	select {
+	case <-fs.ended:
+	default:
+		t.Error("stream not ended")
+	}
+	// Everything has shut down by the time Close returns.
+	select {
+	case _, ok := <-cl.Recv:
+		if ok {
+			t.Error("stanza after Close")
+		}
+	default:
+		t.Error("recv still open")
+	}
+	for name, done := range map[string]<-chan struct{}{
+		"recv filters": cl.recvFilters.done,
+		"send filters": cl.sendFilters.done,
+		"roster":       cl.Roster.done,
+		"presences":    cl.Presences.done,
+		"muc":          cl.MUC.done,
+		"status":       cl.statmgr.done,
+	} {
+		select {
+		case <-done:
+		default:
+			t.Errorf("%s still running", name)
+		}
+	}
+	// Sending after Close doesn't block.
+	select {
+	case cl.Send <- &Message{}:
+	case <-time.After(time.Second):
+		t.Error("Send blocked after Close")
+	}
+}
+
+// Close doesn't wait forever for the app to read what's delivered to
+// it.
+func TestCloseUnread(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	cl := fs.client(WithCloseTimeout(100 * time.Millisecond))
+	evs, _ := cl.Presences.Subscribe()
+	fs.next()
+	fs.write(`<presence from="a@b.c/r"/>`)
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	cl.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Close took %v", d)
+	}
+	for range evs {
+	}
+	for range cl.Recv {
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	fs := newFakeServer(t)
+	defer fs.close()
+	fs.mute = true
+	cl := fs.client(WithCloseTimeout(100 * time.Millisecond))
+
+	start := time.Now()
+	cl.Close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Close took %v", d)
+	}
+	if err := cl.SendRaw(&Presence{}); err != ErrClosed {
+		t.Errorf("SendRaw after Close: %v", err)
+	}
+}